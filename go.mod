@@ -1,17 +1,44 @@
 module github.com/testground/sdk-go
 
-go 1.14
+go 1.18
 
 require (
+	github.com/alicebob/miniredis/v2 v2.30.5
 	github.com/avast/retry-go v2.6.0+incompatible
 	github.com/dustin/go-humanize v1.0.0
+	github.com/fxamacker/cbor/v2 v2.4.0
 	github.com/hashicorp/go-multierror v1.1.0
 	github.com/influxdata/influxdb1-client v0.0.0-20200515024757-02f0bf5dbca3
 	github.com/prometheus/client_golang v1.7.1
 	github.com/raulk/clock v1.1.0
 	github.com/rcrowley/go-metrics v0.0.0-20200313005456-10cdbea86bc0
+	github.com/redis/go-redis/v9 v9.0.5
 	github.com/stretchr/testify v1.5.1
 	github.com/testground/sync-service v0.1.0
 	go.uber.org/zap v1.16.0
+	google.golang.org/protobuf v1.25.0
 	nhooyr.io/websocket v1.8.6
 )
+
+require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/golang/protobuf v1.4.2 // indirect
+	github.com/hashicorp/errwrap v1.0.0 // indirect
+	github.com/klauspost/compress v1.10.3 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.10.0 // indirect
+	github.com/prometheus/procfs v0.1.3 // indirect
+	github.com/testground/testground v0.5.3 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	github.com/yuin/gopher-lua v1.1.0 // indirect
+	go.uber.org/atomic v1.6.0 // indirect
+	go.uber.org/multierr v1.5.0 // indirect
+	golang.org/x/sys v0.0.0-20200625212154-ddb9806d33ae // indirect
+	gopkg.in/yaml.v2 v2.2.8 // indirect
+)
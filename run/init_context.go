@@ -2,7 +2,6 @@ package run
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/testground/sdk-go/network"
 	"github.com/testground/sdk-go/runtime"
@@ -10,18 +9,24 @@ import (
 )
 
 const (
-	StateInitializedGlobal   = sync.State("initialized_global")
+	StateInitializedGlobal = sync.State("initialized_global")
+	// StateInitialized is scoped to the group of the instance, with
+	// State.InGroup, to claim the group-scoped seq number.
+	StateInitialized = sync.State("initialized")
+
+	// Deprecated: the group-scoped state is StateInitialized.InGroup(group).
 	StateInitializedGroupFmt = "initialized_group_%s"
 )
 
 // InitSyncClientFactory is the function that will be called to initialize a
 // sync client as part of an InitContext.
 //
+// The default factory returns a shared client, so that libraries calling
+// sync.NewSharedClient reuse its connection to the sync service.
+//
 // Replaced in testing.
 var InitSyncClientFactory = func(ctx context.Context, env *runtime.RunEnv) sync.Client {
-	// cannot assign sync.MustBoundClient directly because Go can't infer the contravariance
-	// in the return type (i.e. that *sync.DefaultClient satisfies sync.Client).
-	return sync.MustBoundClient(ctx, env)
+	return sync.MustSharedClient(ctx, env)
 }
 
 // InitContext encapsulates a sync client, a net client, and global and
@@ -29,7 +34,7 @@ var InitSyncClientFactory = func(ctx context.Context, env *runtime.RunEnv) sync.
 //
 // The states we signal to acquire the global and group-scoped seq numbers are:
 //  - initialized_global
-//  - initialized_group_<id>
+//  - initialized, scoped to the group with State.InGroup
 type InitContext struct {
 	SyncClient sync.Client
 	NetClient  *network.Client
@@ -42,7 +47,7 @@ type InitContext struct {
 // init can be safely invoked on a nil reference.
 func (ic *InitContext) init(runenv *runtime.RunEnv) {
 	var (
-		grpstate  = sync.State(fmt.Sprintf(StateInitializedGroupFmt, runenv.TestGroupID))
+		grpstate  = StateInitialized.InGroup(runenv.TestGroupID)
 		client    = InitSyncClientFactory(context.Background(), runenv)
 		netclient = network.NewClient(client, runenv)
 	)
@@ -59,7 +64,15 @@ func (ic *InitContext) init(runenv *runtime.RunEnv) {
 		runenv:     runenv,
 	}
 
-	runenv.AttachSyncClient(client)
+	// the network and the sequence numbers are set up through the plain
+	// client; chaos, if configured, applies to the test plan only.
+	chaotic, err := sync.WithChaos(client, &runenv.RunParams)
+	if err != nil {
+		panic(err)
+	}
+	ic.SyncClient = chaotic
+
+	runenv.AttachSyncClient(chaotic)
 
 	runenv.RecordMessage("claimed sequence numbers; global=%d, group(%s)=%d", ic.GlobalSeq, runenv.TestGroupID, ic.GroupSeq)
 }
@@ -85,7 +98,7 @@ func (ic *InitContext) MustWaitAllInstancesInitialized(ctx context.Context) {
 
 // WaitGroupInstancesInitialized waits for all group instances to initialize.
 func (ic *InitContext) WaitGroupInstancesInitialized(ctx context.Context) error {
-	grpstate := sync.State(fmt.Sprintf(StateInitializedGroupFmt, ic.runenv.TestGroupID))
+	grpstate := StateInitialized.InGroup(ic.runenv.TestGroupID)
 	return <-ic.SyncClient.MustBarrier(ctx, grpstate, ic.runenv.TestGroupInstanceCount).C
 }
 
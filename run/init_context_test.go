@@ -0,0 +1,43 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/testground/sdk-go/runtime"
+	"github.com/testground/sdk-go/sync"
+	"github.com/testground/sdk-go/sync/synctest"
+)
+
+// defaultInitSyncClientFactory is the factory in effect before the tests of
+// this package replace it.
+var defaultInitSyncClientFactory = InitSyncClientFactory
+
+func TestInitSyncClientFactoryMetrics(t *testing.T) {
+	srv := synctest.NewServer()
+	t.Cleanup(srv.Close)
+	t.Setenv(sync.EnvServiceHost, srv.Host())
+	t.Setenv(sync.EnvServicePort, srv.Port())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	runenv, cleanup := runtime.RandomTestRunEnv(t)
+	t.Cleanup(cleanup)
+
+	client := defaultInitSyncClientFactory(ctx, runenv)
+	defer client.Close()
+
+	client.MustPublish(ctx, sync.NewTopic("metrics", ""), "hello")
+	client.MustSignalEntry(ctx, "metrics")
+
+	// the requests are timed in the RunEnv, although the connection is shared.
+	for _, op := range []string{sync.OpPublish, sync.OpSignalEntry} {
+		timer := runenv.D().Timer(fmt.Sprintf("%s,op=%s", sync.RequestDurationTimer, op))
+		require.EqualValues(t, 1, timer.Count(), op)
+	}
+}
@@ -17,9 +17,9 @@ import (
 )
 
 func init() {
-	syncClient := sync.NewInmemClient()
-	InitSyncClientFactory = func(_ context.Context, _ *runtime.RunEnv) sync.Client {
-		return syncClient
+	hub := sync.NewInmemHub()
+	InitSyncClientFactory = func(_ context.Context, env *runtime.RunEnv) sync.Client {
+		return hub.NewBoundClient(&env.RunParams)
 	}
 }
 
@@ -50,7 +50,7 @@ func TestInitializedInvoke(t *testing.T) {
 	}
 
 	// we simulate starting many instances by calling invoke multiple times.
-	// all invocations are backed by the same inmem sync service instance.
+	// all invocations are backed by the same inmem sync hub.
 	Invoke(test)
 	Invoke(test)
 	Invoke(test)
@@ -3,13 +3,15 @@ package sync
 import (
 	"context"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/testground/sdk-go/runtime"
-	tgsync "github.com/testground/sync-service"
 	"go.uber.org/zap"
-	"nhooyr.io/websocket"
 )
 
 const (
@@ -21,6 +23,55 @@ const (
 // is passed in. See WithRunParams to bind RunParams to the context.
 var ErrNoRunParameters = fmt.Errorf("no run parameters provided")
 
+// ErrConnectionLost is reported to in-flight publish and signal requests when
+// the connection to the sync service drops before their response arrives.
+// Those requests are not replayed after reconnecting, as they're not
+// idempotent; the caller must decide whether to retry them.
+var ErrConnectionLost = fmt.Errorf("connection to sync service lost")
+
+// ErrClientClosed is returned by Subscription.Err when the subscription was
+// terminated because its client was closed.
+var ErrClientClosed = fmt.Errorf("sync client closed")
+
+// ErrClientShutdown is returned by the requests issued after
+// DefaultClient.Shutdown has been called, and by Subscription.Err when the
+// subscription was terminated by it.
+var ErrClientShutdown = fmt.Errorf("sync client shut down")
+
+// RequestError is returned when a request to the sync service fails. ID is the
+// ID of the request, as logged by the client and by the sync service.
+type RequestError struct {
+	ID  string
+	Err error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("sync request %s failed: %s", e.ID, e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	// ReconnectMinBackoff is the delay before the first redial attempt after
+	// the connection to the sync service drops. It doubles after every failed
+	// attempt, up to ReconnectMaxBackoff.
+	ReconnectMinBackoff = 100 * time.Millisecond
+
+	// ReconnectMaxBackoff is the maximum delay between redial attempts.
+	ReconnectMaxBackoff = 5 * time.Second
+
+	// ReconnectTimeout is how long the DefaultClient will keep trying to
+	// reconnect to the sync service before giving up and aborting the test
+	// instance.
+	ReconnectTimeout = 5 * time.Minute
+
+	// WriteTimeout is how long the DefaultClient waits for a request to be
+	// written to the connection to the sync service before failing it.
+	WriteTimeout = time.Second
+)
+
 type DefaultClient struct {
 	*sugarOperations
 
@@ -29,12 +80,33 @@ type DefaultClient struct {
 	wg        sync.WaitGroup
 	log       *zap.SugaredLogger
 	extractor func(ctx context.Context) (rp *runtime.RunParams)
+	metrics   *instruments
+	subs      subscriptionSet
+
+	nextMu   sync.Mutex
+	next     uint64
+	idPrefix string
+	handlers *handlerMap
 
-	nextMu     sync.Mutex
-	next       int
-	handlersMu sync.Mutex
-	handlers   map[string]chan *tgsync.Response
-	socket     *websocket.Conn
+	// socketMu guards the socket and the closing and draining flags. Writes
+	// are performed while holding it, so that a reconnection can never
+	// interleave with a request being registered and written.
+	socketMu sync.Mutex
+	socket   Transport
+	dial     Dialer
+	closing  bool
+	draining bool
+
+	// unacked counts the publishes and signals awaiting a response; drained
+	// is closed when it drops to zero while draining. See Shutdown.
+	ackMu   sync.Mutex
+	unacked int
+	drained chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+
+	readTimeout time.Duration
 }
 
 // NewBoundClient returns a new sync DefaultClient that is bound to the provided
@@ -51,7 +123,7 @@ func NewBoundClient(ctx context.Context, runenv *runtime.RunEnv) (*DefaultClient
 
 	return newClient(ctx, log, func(ctx context.Context) *runtime.RunParams {
 		return &runenv.RunParams
-	})
+	}, runenv)
 }
 
 // MustBoundClient creates a new bound client by calling NewBoundClient, and
@@ -78,7 +150,7 @@ func MustBoundClient(ctx context.Context, runenv *runtime.RunEnv) *DefaultClient
 // A suitable context to pass here is the background context of the main
 // process.
 func NewGenericClient(ctx context.Context, log *zap.SugaredLogger) (*DefaultClient, error) {
-	return newClient(ctx, log, GetRunParams)
+	return newClient(ctx, log, GetRunParams, nil)
 }
 
 // MustGenericClient creates a new generic client by calling NewGenericClient,
@@ -91,26 +163,80 @@ func MustGenericClient(ctx context.Context, log *zap.SugaredLogger) *DefaultClie
 	return c
 }
 
-// newClient creates a new sync client.
-func newClient(ctx context.Context, log *zap.SugaredLogger, extractor func(ctx context.Context) *runtime.RunParams) (*DefaultClient, error) {
+// NewBoundClientWithDialer is like NewBoundClient, but connects to the sync
+// service through the Transports established by the supplied Dialer, rather
+// than the websocket at the address given by the environment. See DialerFor.
+func NewBoundClientWithDialer(ctx context.Context, runenv *runtime.RunEnv, dial Dialer) (*DefaultClient, error) {
+	return newClientWithDialer(ctx, runenv.SLogger(), func(ctx context.Context) *runtime.RunParams {
+		return &runenv.RunParams
+	}, runenv, dial, DefaultReadTimeout)
+}
+
+// NewGenericClientWithDialer is like NewGenericClient, but connects to the sync
+// service through the Transports established by the supplied Dialer. See
+// DialerFor.
+func NewGenericClientWithDialer(ctx context.Context, log *zap.SugaredLogger, dial Dialer) (*DefaultClient, error) {
+	return newClientWithDialer(ctx, log, GetRunParams, nil, dial, DefaultReadTimeout)
+}
+
+// logFor returns the logger for the requests issued with the supplied
+// context: that of its binding, if any, or the client's.
+func (c *DefaultClient) logFor(ctx context.Context) *zap.SugaredLogger {
+	if b := bindingOf(ctx); b != nil && b.log != nil {
+		return b.log
+	}
+	return c.log
+}
+
+// metricsFor returns the instruments for the requests issued with the
+// supplied context: those of its binding, if any, or the client's.
+func (c *DefaultClient) metricsFor(ctx context.Context) *instruments {
+	if b := bindingOf(ctx); b != nil && b.metrics != nil {
+		return b.metrics
+	}
+	return c.metrics
+}
+
+// runenvFor returns the RunEnv of the requests issued with the supplied
+// context: that of its binding, if any, or the client's, which is nil for
+// generic clients.
+func (c *DefaultClient) runenvFor(ctx context.Context) *runtime.RunEnv {
+	if b := bindingOf(ctx); b != nil && b.runenv != nil {
+		return b.runenv
+	}
+	return c.runenv
+}
+
+// newClient creates a new sync client connected to the sync service at the
+// address given by the environment. The RunEnv is nil for generic clients.
+func newClient(ctx context.Context, log *zap.SugaredLogger, extractor func(ctx context.Context) *runtime.RunParams, runenv *runtime.RunEnv) (*DefaultClient, error) {
+	addr, err := socketAddress()
+	if err != nil {
+		return nil, err
+	}
+	return newClientWithDialer(ctx, log, extractor, runenv, WebSocketDialer(addr, nil), DefaultReadTimeout)
+}
+
+func newClientWithDialer(ctx context.Context, log *zap.SugaredLogger, extractor func(ctx context.Context) *runtime.RunParams, runenv *runtime.RunEnv, dial Dialer, readTimeout time.Duration) (*DefaultClient, error) {
 	ctx, cancel := context.WithCancel(ctx)
 	c := &DefaultClient{
 		ctx:       ctx,
 		cancel:    cancel,
 		log:       log,
 		extractor: extractor,
-		handlers:  map[string]chan *tgsync.Response{},
-	}
-
-	c.sugarOperations = &sugarOperations{c}
+		metrics:   newInstruments(runenv),
+		idPrefix:  newIDPrefix(),
+		handlers:  newHandlerMap(),
+		dial:      dial,
 
-	addr, err := socketAddress()
-	if err != nil {
-		return nil, err
+		readTimeout: readTimeout,
 	}
 
-	c.socket, _, err = websocket.Dial(ctx, addr, nil)
-	if err != nil {
+	c.sugarOperations = &sugarOperations{Client: c, extractor: extractor, runenv: runenv, log: log}
+
+	var err error
+	if c.socket, err = dial(ctx); err != nil {
+		cancel()
 		return nil, err
 	}
 
@@ -120,18 +246,111 @@ func newClient(ctx context.Context, log *zap.SugaredLogger, extractor func(ctx c
 	return c, nil
 }
 
+// Subscriptions returns the active subscriptions of this client, oldest
+// first. Subscriptions still active when the client is closed are logged, as
+// they're likely to have been leaked.
+func (c *DefaultClient) Subscriptions() []*Subscription {
+	return c.subs.list()
+}
+
 // Close closes this client, cancels ongoing operations, and releases resources.
+//
+// Requests in flight are abandoned; use Shutdown to wait for them. Calling
+// Close more than once returns the result of the first call.
 func (c *DefaultClient) Close() error {
-	err := c.socket.Close(websocket.StatusNormalClosure, "")
-	if err != nil {
-		return err
+	c.closeOnce.Do(func() {
+		if !c.isDraining() {
+			c.subs.warnActive(c.log)
+		}
+
+		c.socketMu.Lock()
+		c.closing = true
+		socket := c.socket
+		c.socketMu.Unlock()
+
+		c.closeErr = socket.Close()
+
+		c.cancel()
+		c.wg.Wait()
+		c.metrics.release()
+	})
+	return c.closeErr
+}
+
+// Shutdown closes this client gracefully. It stops accepting new requests,
+// which fail with ErrClientShutdown, and waits for the publishes and signals
+// in flight to be acknowledged by the sync service, until the supplied context
+// fires. It then closes the client, terminating the active subscriptions and
+// barriers; Subscription.Err returns ErrClientShutdown for them.
+//
+// It returns an error if the context fired before all requests were
+// acknowledged, or if closing failed. It is safe to call Shutdown multiple
+// times, and concurrently with Close.
+func (c *DefaultClient) Shutdown(ctx context.Context) error {
+	c.socketMu.Lock()
+	c.draining = true
+	c.socketMu.Unlock()
+
+	c.ackMu.Lock()
+	if c.drained == nil {
+		c.drained = make(chan struct{})
+		if c.unacked == 0 {
+			close(c.drained)
+		}
 	}
+	drained, unacked := c.drained, c.unacked
+	c.ackMu.Unlock()
+
+	c.log.Debugw("shutting down sync client", "unacknowledged", unacked)
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		c.ackMu.Lock()
+		unacked = c.unacked
+		c.ackMu.Unlock()
+		err = fmt.Errorf("shutdown abandoned %d unacknowledged requests: %w", unacked, ctx.Err())
+	}
+
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// isDraining returns whether Shutdown has been called.
+func (c *DefaultClient) isDraining() bool {
+	c.socketMu.Lock()
+	defer c.socketMu.Unlock()
+	return c.draining
+}
 
-	c.cancel()
-	c.wg.Wait()
-	return nil
+// track counts a request awaiting acknowledgement.
+func (c *DefaultClient) track() {
+	c.ackMu.Lock()
+	c.unacked++
+	c.ackMu.Unlock()
 }
 
+// ack accounts for an acknowledged, or abandoned, request.
+func (c *DefaultClient) ack() {
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
+
+	if c.unacked--; c.unacked > 0 || c.drained == nil {
+		return
+	}
+	select {
+	case <-c.drained:
+	default:
+		close(c.drained)
+	}
+}
+
+// socketAddress returns the websocket address of the sync service, given by the
+// SYNC_SERVICE_HOST and SYNC_SERVICE_PORT environment variables, which default
+// to the address of the sync service within a Testground deployment.
 func socketAddress() (string, error) {
 	var (
 		port = os.Getenv(EnvServicePort)
@@ -140,11 +359,38 @@ func socketAddress() (string, error) {
 
 	if port == "" {
 		port = "5050"
+	} else if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid %s: %q", EnvServicePort, port)
 	}
 
 	if host == "" {
 		host = "testground-sync-service"
+	} else if h := strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"); net.ParseIP(h) != nil {
+		host = h
+	} else if !validHostname(host) {
+		return "", fmt.Errorf("invalid %s: %q; expected a host name or IP address", EnvServiceHost, host)
 	}
 
-	return fmt.Sprintf("ws://%s:%s", host, port), nil
+	return "ws://" + net.JoinHostPort(host, port), nil
+}
+
+// validHostname reports whether a host name is made of dot-separated labels of
+// letters, digits, hyphens and underscores, which container names may contain.
+func validHostname(host string) bool {
+	if len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			default:
+				return false
+			}
+		}
+	}
+	return true
 }
@@ -0,0 +1,280 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/testground/sdk-go/runtime"
+)
+
+// Instance parameters that configure the chaos mode of the sync client. See
+// Chaos for their meaning. Rates are numbers between 0 and 1; delays are
+// durations in the format accepted by time.ParseDuration.
+const (
+	ChaosPublishDropParam      = "sync_chaos_publish_drop"
+	ChaosPublishDelayRateParam = "sync_chaos_publish_delay_rate"
+	ChaosPublishDelayParam     = "sync_chaos_publish_delay"
+	ChaosDuplicateParam        = "sync_chaos_duplicate"
+	ChaosBarrierDelayParam     = "sync_chaos_barrier_delay"
+	ChaosSeedParam             = "sync_chaos_seed"
+)
+
+// ChaosDroppedSeq is the sequence number reported, along with a nil error, for
+// the entries that a ChaosInterceptor drops instead of publishing them. Real
+// sequence numbers are positive.
+const ChaosDroppedSeq int64 = -1
+
+// ErrPublishDropped is returned by the primitives of this package, like
+// Counter, Semaphore and KV, when an entry they rely on was dropped by a
+// ChaosInterceptor, as they have no way to recover it.
+var ErrPublishDropped = errors.New("published entry was dropped")
+
+// Chaos configures the faults a ChaosInterceptor introduces in the sync
+// traffic of a test plan, to verify that the plan copes with a misbehaving
+// sync service.
+type Chaos struct {
+	// PublishDropRate is the probability of a published entry being silently
+	// dropped. The publisher observes a success, with sequence number
+	// ChaosDroppedSeq; the primitives of this package fail with
+	// ErrPublishDropped instead.
+	PublishDropRate float64
+	// PublishDelayRate is the probability of a publish being delayed by a
+	// random duration up to PublishDelay.
+	PublishDelayRate float64
+	PublishDelay     time.Duration
+	// DuplicateRate is the probability of an entry being delivered twice to
+	// a subscriber, back to back. The primitives of this package discard
+	// duplicates.
+	DuplicateRate float64
+	// BarrierDelay delays the release of every barrier by a random duration
+	// up to BarrierDelay. Failed barriers are reported immediately.
+	BarrierDelay time.Duration
+	// Seed seeds the random source, for reproducible chaos.
+	Seed int64
+}
+
+// Enabled returns whether this configuration introduces any fault.
+func (c Chaos) Enabled() bool {
+	return c.PublishDropRate > 0 ||
+		(c.PublishDelayRate > 0 && c.PublishDelay > 0) ||
+		c.DuplicateRate > 0 ||
+		c.BarrierDelay > 0
+}
+
+// ChaosFromRunParams parses the chaos configuration from the Chaos*Param
+// instance parameters. Parameters that are not set disable the corresponding
+// fault; if the seed is not set, the random source is seeded with the current
+// time.
+func ChaosFromRunParams(rp *runtime.RunParams) (Chaos, error) {
+	c := Chaos{Seed: time.Now().UnixNano()}
+
+	rates := []struct {
+		name string
+		dst  *float64
+	}{
+		{ChaosPublishDropParam, &c.PublishDropRate},
+		{ChaosPublishDelayRateParam, &c.PublishDelayRate},
+		{ChaosDuplicateParam, &c.DuplicateRate},
+	}
+	for _, r := range rates {
+		v, ok := rp.TestInstanceParams[r.name]
+		if !ok {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			return Chaos{}, fmt.Errorf("invalid value for %s: %q; expected a rate between 0 and 1", r.name, v)
+		}
+		*r.dst = f
+	}
+
+	delays := []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{ChaosPublishDelayParam, &c.PublishDelay},
+		{ChaosBarrierDelayParam, &c.BarrierDelay},
+	}
+	for _, d := range delays {
+		v, ok := rp.TestInstanceParams[d.name]
+		if !ok {
+			continue
+		}
+		dur, err := time.ParseDuration(v)
+		if err != nil || dur < 0 {
+			return Chaos{}, fmt.Errorf("invalid value for %s: %q; expected a duration", d.name, v)
+		}
+		*d.dst = dur
+	}
+
+	if v, ok := rp.TestInstanceParams[ChaosSeedParam]; ok {
+		seed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return Chaos{}, fmt.Errorf("invalid value for %s: %q; expected an integer", ChaosSeedParam, v)
+		}
+		c.Seed = seed
+	}
+
+	return c, nil
+}
+
+// WithChaos returns a Client that introduces the faults configured through the
+// instance parameters in the supplied RunParams, or the supplied Client itself
+// if chaos mode is not enabled. It works with any Client. See
+// ChaosFromRunParams.
+func WithChaos(client Client, rp *runtime.RunParams) (Client, error) {
+	c, err := ChaosFromRunParams(rp)
+	if err != nil {
+		return nil, err
+	}
+	if !c.Enabled() {
+		return client, nil
+	}
+	loggerOf(client).Infow("sync chaos mode enabled", "config", c)
+	return WithInterceptors(client, ChaosInterceptor(c)), nil
+}
+
+// ChaosInterceptor drops and delays publishes, duplicates deliveries, and
+// delays barrier releases, as configured.
+func ChaosInterceptor(c Chaos) Interceptor {
+	var (
+		mu  sync.Mutex
+		rnd = rand.New(rand.NewSource(c.Seed))
+	)
+
+	// chance returns true with the supplied probability.
+	chance := func(p float64) bool {
+		if p <= 0 {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return rnd.Float64() < p
+	}
+
+	// upTo returns a random duration up to max.
+	upTo := func(max time.Duration) time.Duration {
+		if max <= 0 {
+			return 0
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return time.Duration(rnd.Int63n(int64(max) + 1))
+	}
+
+	sleep := func(ctx context.Context, d time.Duration) error {
+		if d <= 0 {
+			return nil
+		}
+		select {
+		case <-time.After(d):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return func(ctx context.Context, call *Call, next Invoker) (*Result, error) {
+		switch call.Op {
+		case OpPublish:
+			if chance(c.PublishDelayRate) {
+				if err := sleep(ctx, upTo(c.PublishDelay)); err != nil {
+					return nil, err
+				}
+			}
+			if chance(c.PublishDropRate) {
+				return &Result{Seq: ChaosDroppedSeq}, nil
+			}
+			return next(ctx, call)
+
+		case OpPublishBatch:
+			if chance(c.PublishDelayRate) {
+				if err := sleep(ctx, upTo(c.PublishDelay)); err != nil {
+					return nil, err
+				}
+			}
+			// drop individual entries, and report them with ChaosDroppedSeq.
+			var (
+				kept    = make([]interface{}, 0, len(call.Payloads))
+				dropped = make([]bool, len(call.Payloads))
+			)
+			for i, p := range call.Payloads {
+				if dropped[i] = chance(c.PublishDropRate); !dropped[i] {
+					kept = append(kept, p)
+				}
+			}
+			if len(kept) == len(call.Payloads) {
+				return next(ctx, call)
+			}
+
+			res := &Result{Seqs: make([]int64, len(call.Payloads))}
+			for i := range res.Seqs {
+				res.Seqs[i] = ChaosDroppedSeq
+			}
+			if len(kept) > 0 {
+				batch := *call
+				batch.Payloads = kept
+				r, err := next(ctx, &batch)
+				if err != nil {
+					return nil, err
+				}
+				for i, j := 0, 0; i < len(dropped); i++ {
+					if !dropped[i] {
+						res.Seqs[i] = r.Seqs[j]
+						j++
+					}
+				}
+			}
+			return res, nil
+
+		case OpSubscribe:
+			if c.DuplicateRate <= 0 {
+				return next(ctx, call)
+			}
+			subscribe := func(ctx context.Context, inner interface{}) (*Subscription, error) {
+				sub := *call
+				sub.Ch = inner
+				res, err := next(ctx, &sub)
+				if err != nil {
+					return nil, err
+				}
+				return res.Subscription, nil
+			}
+			forward := func(v reflect.Value, send func(reflect.Value) bool) {
+				if send(v) && chance(c.DuplicateRate) {
+					send(v)
+				}
+			}
+			sub, err := interpose(ctx, call.Ch, subscribe, forward, nil)
+			if err != nil {
+				return nil, err
+			}
+			return &Result{Subscription: sub}, nil
+
+		case OpBarrier:
+			res, err := next(ctx, call)
+			if err != nil || c.BarrierDelay <= 0 {
+				return res, err
+			}
+			b := &Barrier{C: make(chan error, 1)}
+			go func(inner *Barrier) {
+				err := <-inner.C
+				if err == nil {
+					// a fired context releases the barrier right away.
+					_ = sleep(ctx, upTo(c.BarrierDelay))
+				}
+				b.C <- err
+			}(res.Barrier)
+			return &Result{Barrier: b}, nil
+
+		default:
+			return next(ctx, call)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package sync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/testground/sdk-go/runtime"
+)
+
+func TestChaosFromRunParams(t *testing.T) {
+	rp := &runtime.RunParams{TestInstanceParams: map[string]string{
+		ChaosPublishDropParam:  "0.25",
+		ChaosBarrierDelayParam: "50ms",
+		ChaosSeedParam:         "42",
+	}}
+	c, err := ChaosFromRunParams(rp)
+	require.NoError(t, err)
+	require.Equal(t, Chaos{PublishDropRate: 0.25, BarrierDelay: 50 * time.Millisecond, Seed: 42}, c)
+	require.True(t, c.Enabled())
+
+	rp.TestInstanceParams[ChaosDuplicateParam] = "2"
+	_, err = ChaosFromRunParams(rp)
+	require.Error(t, err)
+
+	// no chaos parameters leave the client untouched.
+	client := NewInmemClient()
+	defer client.Close()
+	wrapped, err := WithChaos(client, &runtime.RunParams{})
+	require.NoError(t, err)
+	require.Equal(t, Client(client), wrapped)
+}
+
+func TestChaos(t *testing.T) {
+	forEachClient(t, func(t *testing.T, client Client) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		chaotic := WithInterceptors(client, ChaosInterceptor(Chaos{
+			DuplicateRate: 1,
+			BarrierDelay:  100 * time.Millisecond,
+		}))
+		dropping := WithInterceptors(client, ChaosInterceptor(Chaos{PublishDropRate: 1}))
+
+		topic := NewTopic("chaos", 0)
+		seq, err := dropping.Publish(ctx, topic, 1)
+		require.NoError(t, err)
+		require.Equal(t, ChaosDroppedSeq, seq)
+		seqs, err := dropping.PublishBatch(ctx, topic, []interface{}{2, 3})
+		require.NoError(t, err)
+		require.Equal(t, []int64{ChaosDroppedSeq, ChaosDroppedSeq}, seqs)
+
+		chaotic.MustPublish(ctx, topic, 4)
+
+		ch := make(chan int, 4)
+		chaotic.MustSubscribe(ctx, topic, ch)
+		require.Equal(t, 4, <-ch)
+		require.Equal(t, 4, <-ch)
+
+		chaotic.MustSignalEntry(ctx, "chaos")
+		start := time.Now()
+		b, err := chaotic.Barrier(ctx, "chaos", 1)
+		require.NoError(t, err)
+		require.NoError(t, <-b.C)
+		require.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	})
+}
@@ -2,69 +2,307 @@ package sync
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
-	"strconv"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
 	"time"
 
-	sync "github.com/testground/sync-service"
-	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
+	tgsync "github.com/testground/sync-service"
 )
 
-func (c *DefaultClient) nextID() (id string) {
+// handler tracks an in-flight request, and routes the responses to it.
+type handler struct {
+	req *tgsync.Request
+	ctx context.Context
+	ch  chan *tgsync.Response
+
+	// mu is held while delivering a response, so that ch is never closed
+	// while a send is pending.
+	mu     sync.Mutex
+	closed bool
+	// tracked is set while the request is counted as awaiting
+	// acknowledgement; see DefaultClient.Shutdown.
+	tracked bool
+
+	// seen is the number of subscription entries delivered so far, and offset
+	// is the position of the last entry received on the current connection.
+	// The sync service replays a topic from the beginning when we resubscribe
+	// after a reconnection, so entries up to seen are discarded.
+	//
+	// Only accessed from the responsesWorker goroutine.
+	seen, offset int
+}
+
+// replayable returns whether the request can be safely issued again after a
+// reconnection. Subscriptions are deduplicated on our side, and barriers are
+// idempotent. Publishes and signals are not, so we never replay them.
+func (h *handler) replayable() bool {
+	return h.req.SubscribeRequest != nil || h.req.BarrierRequest != nil
+}
+
+// handlerShards is the number of shards of the handlers map.
+const handlerShards = 32
+
+// handlerMap is a map of in-flight requests by ID, sharded to reduce lock
+// contention between the goroutines issuing requests and the
+// responsesWorker.
+type handlerMap struct {
+	shards [handlerShards]struct {
+		sync.Mutex
+		m map[string]*handler
+	}
+}
+
+func newHandlerMap() *handlerMap {
+	hm := new(handlerMap)
+	for i := range hm.shards {
+		hm.shards[i].m = make(map[string]*handler)
+	}
+	return hm
+}
+
+func (hm *handlerMap) shard(id string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return int(h.Sum32() % handlerShards)
+}
+
+func (hm *handlerMap) get(id string) *handler {
+	s := &hm.shards[hm.shard(id)]
+	s.Lock()
+	defer s.Unlock()
+	return s.m[id]
+}
+
+func (hm *handlerMap) put(h *handler) {
+	s := &hm.shards[hm.shard(h.req.ID)]
+	s.Lock()
+	s.m[h.req.ID] = h
+	s.Unlock()
+}
+
+// remove removes the handler, unless it has been replaced.
+func (hm *handlerMap) remove(h *handler) {
+	s := &hm.shards[hm.shard(h.req.ID)]
+	s.Lock()
+	if s.m[h.req.ID] == h {
+		delete(s.m, h.req.ID)
+	}
+	s.Unlock()
+}
+
+// each calls fn with every shard, while holding its lock.
+func (hm *handlerMap) each(fn func(shard map[string]*handler)) {
+	for i := range hm.shards {
+		s := &hm.shards[i]
+		s.Lock()
+		fn(s.m)
+		s.Unlock()
+	}
+}
+
+// nextID returns a new request ID, of the form <run>/<group>/<host>/<nonce>-<n>.
+// The run and group are those of the request, if known; host is the hostname
+// of the instance, and nonce is random to this client. IDs are thus unique
+// across instances, processes, and the reconnections of a client, and the logs
+// of the sync service can be joined with those of the instances on them.
+func (c *DefaultClient) nextID(ctx context.Context) string {
+	var run, group string
+	if rp := c.extractor(ctx); rp != nil {
+		run, group = rp.TestRun, rp.TestGroupID
+	}
 	c.nextMu.Lock()
-	id = strconv.Itoa(c.next)
 	c.next++
+	n := c.next
 	c.nextMu.Unlock()
-	return id
+	return fmt.Sprintf("%s/%s/%s-%d", run, group, c.idPrefix, n)
+}
+
+// responseError returns the error carried by a response, if any, as a
+// RequestError.
+func responseError(res *tgsync.Response) error {
+	if res.Error == "" {
+		return nil
+	}
+	err := errors.New(res.Error)
+	if res.Error == ErrConnectionLost.Error() {
+		err = ErrConnectionLost
+	}
+	return &RequestError{ID: res.ID, Err: err}
+}
+
+// newIDPrefix returns the <host>/<nonce> prefix of the request IDs of a new
+// client.
+func newIDPrefix() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "unknown"
+	}
+	var nonce [4]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		// fall back to the process and the time; still unique in practice.
+		binary.BigEndian.PutUint32(nonce[:], uint32(os.Getpid())^uint32(time.Now().UnixNano()))
+	}
+	return host + "/" + hex.EncodeToString(nonce[:])
 }
 
 func (c *DefaultClient) responsesWorker() {
+	defer c.wg.Done()
+
 	for {
 		res, err := c.readSocket()
 		if err != nil {
-			if errors.Is(err, context.Canceled) ||
-				errors.Is(c.ctx.Err(), context.Canceled) ||
-				websocket.CloseStatus(err) == websocket.StatusNormalClosure {
-				break
+			if c.isClosing() || errors.Is(err, context.Canceled) || c.ctx.Err() != nil {
+				return
 			}
 
-			c.log.Fatalw("error while reading socket", "error", err)
+			c.log.Warnw("lost connection to sync service; reconnecting", "error", err)
+			if err := c.reconnect(); err != nil {
+				if c.isClosing() || c.ctx.Err() != nil {
+					return
+				}
+				c.log.Fatalw("failed to reconnect to sync service", "error", err)
+			}
+			c.log.Infow("reconnected to sync service")
+			continue
 		}
 
-		var ch chan *sync.Response
-		c.handlersMu.Lock()
-		ch = c.handlers[res.ID]
-		c.handlersMu.Unlock()
+		h := c.handlers.get(res.ID)
 
-		if ch == nil {
+		if h == nil {
 			c.log.Warnf("no handler available for response: %s", res.ID)
-		} else {
-			ch <- res
+			continue
+		}
+
+		if h.req.SubscribeRequest != nil && res.Error == "" {
+			if h.offset++; h.offset <= h.seen {
+				// already delivered before we reconnected.
+				continue
+			}
+			h.seen = h.offset
 		}
+
+		c.deliver(h, res)
+	}
+}
+
+// deliver sends a response to the handler, unless the request has been
+// cancelled.
+func (c *DefaultClient) deliver(h *handler, res *tgsync.Response) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+
+	select {
+	case h.ch <- res:
+		c.settle(h)
+	case <-h.ctx.Done():
+	case <-c.ctx.Done():
+	}
+}
+
+// settle stops counting the request of the handler as awaiting
+// acknowledgement. It must be called with h.mu held.
+func (c *DefaultClient) settle(h *handler) {
+	if h.tracked {
+		h.tracked = false
+		c.ack()
+	}
+}
+
+// removeHandler unregisters the handler and closes its channel.
+func (c *DefaultClient) removeHandler(h *handler) {
+	c.handlers.remove(h)
+
+	h.mu.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.ch)
 	}
+	c.settle(h)
+	h.mu.Unlock()
+}
 
-	c.wg.Done()
+func (c *DefaultClient) makeRequest(ctx context.Context, req *tgsync.Request) (chan *tgsync.Response, error) {
+	chs, err := c.makeRequests(ctx, []*tgsync.Request{req})
+	if err != nil {
+		return nil, err
+	}
+	return chs[0], nil
 }
 
-func (c *DefaultClient) makeRequest(ctx context.Context, req *sync.Request) (chan *sync.Response, error) {
+// makeRequests registers and writes a batch of requests back to back, without
+// waiting for their responses, and returns the channels where the responses to
+// each will be delivered. The handlers are removed when ctx fires.
+func (c *DefaultClient) makeRequests(ctx context.Context, reqs []*tgsync.Request) ([]chan *tgsync.Response, error) {
 	if c.ctx.Err() != nil {
+		if c.isDraining() {
+			return nil, ErrClientShutdown
+		}
 		return nil, errors.New("tried to make request after context being cancelled")
 	}
 
-	if req.ID == "" {
-		req.ID = c.nextID()
+	var (
+		hs         = make([]*handler, 0, len(reqs))
+		chs        = make([]chan *tgsync.Response, 0, len(reqs))
+		replayable = true
+	)
+	for _, req := range reqs {
+		if req.ID == "" {
+			req.ID = c.nextID(ctx)
+		}
+		h := &handler{
+			req: req,
+			ctx: ctx,
+			ch:  make(chan *tgsync.Response),
+		}
+		replayable = replayable && h.replayable()
+		hs = append(hs, h)
+		chs = append(chs, h.ch)
 	}
 
-	ch := make(chan *sync.Response)
-
-	c.handlersMu.Lock()
-	c.handlers[req.ID] = ch
-	c.handlersMu.Unlock()
+	var err error
+	c.socketMu.Lock()
+	switch {
+	case c.draining:
+		c.socketMu.Unlock()
+		return nil, ErrClientShutdown
+	case c.closing:
+		c.socketMu.Unlock()
+		return nil, ErrClientClosed
+	}
+	for _, h := range hs {
+		if !h.replayable() {
+			h.tracked = true
+			c.track()
+		}
+		c.handlers.put(h)
+	}
+	for _, h := range hs {
+		if err = c.writeSocket(c.socket, h.req); err != nil {
+			break
+		}
+	}
+	c.socketMu.Unlock()
 
-	err := c.writeSocket(req)
 	if err != nil {
-		return nil, err
+		if !replayable {
+			for _, h := range hs {
+				c.removeHandler(h)
+			}
+			return nil, err
+		}
+		// the connection is broken; the requests will be replayed once
+		// the responsesWorker reconnects.
+		c.log.Debugw("failed to write requests; will retry after reconnecting", "count", len(hs), "error", err)
 	}
 
 	c.wg.Add(1)
@@ -76,37 +314,112 @@ func (c *DefaultClient) makeRequest(ctx context.Context, req *sync.Request) (cha
 		case <-ctx.Done():
 		}
 
-		c.handlersMu.Lock()
-		close(c.handlers[req.ID])
-		delete(c.handlers, req.ID)
-		c.handlersMu.Unlock()
+		for _, h := range hs {
+			c.removeHandler(h)
+		}
 		c.wg.Done()
 	}()
 
-	return ch, nil
+	return chs, nil
 }
 
-func (c *DefaultClient) readSocket() (*sync.Response, error) {
-	// After one hour without receiving information from the sync service,
-	// the test will inevitably fail. Note(hacdias): consider changing
-	// the timeout to a larger value in case slower tests fail. The same
-	// value must be changed on the sync service side too.
-	ctx, cancel := context.WithTimeout(c.ctx, time.Hour)
-	defer cancel()
+// reconnect redials the sync service with exponential backoff, then replays
+// all replayable in-flight requests on the new connection, and fails the rest
+// with ErrConnectionLost. It must only be called from the responsesWorker.
+func (c *DefaultClient) reconnect() error {
+	c.socketMu.Lock()
+	old := c.socket
+	c.socketMu.Unlock()
 
-	var req *sync.Response
-	err := wsjson.Read(ctx, c.socket, &req)
-	if err != nil {
-		return nil, err
+	_ = old.Close()
+
+	var (
+		socket   Transport
+		err      error
+		backoff  = ReconnectMinBackoff
+		deadline = time.Now().Add(ReconnectTimeout)
+	)
+
+	for attempt := 1; ; attempt++ {
+		if socket, err = c.dial(c.ctx); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		}
+
+		c.log.Debugw("failed to redial sync service", "attempt", attempt, "backoff", backoff, "error", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
+
+		if backoff *= 2; backoff > ReconnectMaxBackoff {
+			backoff = ReconnectMaxBackoff
+		}
 	}
-	if req == nil {
-		return nil, errors.New("received nil from socket")
+
+	c.socketMu.Lock()
+	defer c.socketMu.Unlock()
+
+	if c.closing {
+		_ = socket.Close()
+		return errors.New("client closed while reconnecting")
 	}
-	return req, err
+
+	c.socket = socket
+
+	// every registered handler was written to the old socket, since we hold
+	// socketMu; replay them or fail them.
+	var replay, failed []*handler
+	c.handlers.each(func(shard map[string]*handler) {
+		for id, h := range shard {
+			if h.replayable() {
+				h.offset = 0
+				replay = append(replay, h)
+			} else {
+				delete(shard, id)
+				failed = append(failed, h)
+			}
+		}
+	})
+
+	for _, h := range failed {
+		go c.deliver(h, &tgsync.Response{ID: h.req.ID, Error: ErrConnectionLost.Error()})
+	}
+
+	for _, h := range replay {
+		c.log.Debugw("replaying request after reconnection", "id", h.req.ID)
+		if err := c.writeSocket(socket, h.req); err != nil {
+			// the next read will fail too, and trigger another reconnection.
+			c.log.Warnw("failed to replay request", "id", h.req.ID, "error", err)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (c *DefaultClient) isClosing() bool {
+	c.socketMu.Lock()
+	defer c.socketMu.Unlock()
+	return c.closing
+}
+
+func (c *DefaultClient) readSocket() (*tgsync.Response, error) {
+	// After readTimeout without receiving information from the sync service,
+	// the connection is considered lost. See ClientOptions.ReadTimeout.
+	ctx, cancel := context.WithTimeout(c.ctx, c.readTimeout)
+	defer cancel()
+
+	// the socket is only ever replaced by this goroutine, in reconnect.
+	return c.socket.Read(ctx)
 }
 
-func (c *DefaultClient) writeSocket(req *sync.Request) error {
-	ctx, cancel := context.WithTimeout(c.ctx, time.Second)
+func (c *DefaultClient) writeSocket(socket Transport, req *tgsync.Request) error {
+	ctx, cancel := context.WithTimeout(c.ctx, WriteTimeout)
 	defer cancel()
-	return wsjson.Write(ctx, c.socket, req)
+	return socket.Write(ctx, req)
 }
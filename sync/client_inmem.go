@@ -2,128 +2,447 @@ package sync
 
 import (
 	"context"
-	"reflect"
+	"encoding/json"
+	"fmt"
 	"sync"
 
 	"github.com/testground/sdk-go/runtime"
+	"go.uber.org/zap"
 )
 
-type inmemClient struct {
-	sync.Mutex
+// InmemHub is an in-process stand-in for the sync service. Any number of
+// in-memory clients can be attached to a hub, each bound to the RunParams of
+// a simulated instance, so that entire test plans can be exercised within a
+// single process, e.g. with `go test`.
+//
+// States and topics are namespaced exactly like they are by the sync service,
+// using State.Key and Topic.Key. Payloads are JSON-encoded on publish and
+// decoded on delivery, so subscribers observe the same values they would when
+// running against the real sync service.
+type InmemHub struct {
+	mu     sync.Mutex
+	states map[string]*inmemState
+	topics map[string]*inmemTopic
+}
+
+type inmemState struct {
+	count   int64
+	waiters []*inmemWaiter
+}
+
+// inmemWaiter is a pending barrier; ch is closed when target is reached.
+type inmemWaiter struct {
+	target int64
+	ch     chan struct{}
+}
+
+type inmemTopic struct {
+	entries []string
+
+	// notify is closed, and replaced, whenever an entry is appended.
+	notify chan struct{}
+}
+
+// NewInmemHub creates an empty in-memory sync hub.
+func NewInmemHub() *InmemHub {
+	return &InmemHub{
+		states: make(map[string]*inmemState),
+		topics: make(map[string]*inmemTopic),
+	}
+}
+
+// NewBoundClient returns a new in-memory client attached to this hub, and
+// bound to the supplied RunParams. All operations will be automatically scoped
+// to the keyspace of that run.
+func (h *InmemHub) NewBoundClient(rp *runtime.RunParams) *InmemClient {
+	return newInmemClient(h, func(context.Context) *runtime.RunParams {
+		return rp
+	})
+}
+
+// NewGenericClient returns a new in-memory client attached to this hub, and
+// bound to no RunParams. All operations expect to find the RunParams to scope
+// their actions inside the supplied context.Context. See WithRunParams.
+func (h *InmemHub) NewGenericClient() *InmemClient {
+	return newInmemClient(h, GetRunParams)
+}
+
+func (h *InmemHub) topic(key string) *inmemTopic {
+	t, ok := h.topics[key]
+	if !ok {
+		t = &inmemTopic{notify: make(chan struct{})}
+		h.topics[key] = t
+	}
+	return t
+}
+
+func (h *InmemHub) state(key string) *inmemState {
+	s, ok := h.states[key]
+	if !ok {
+		s = &inmemState{}
+		h.states[key] = s
+	}
+	return s
+}
+
+// publish appends an entry to the topic, returning its sequence number.
+func (h *InmemHub) publish(key string, entry string) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t := h.topic(key)
+	t.entries = append(t.entries, entry)
+	close(t.notify)
+	t.notify = make(chan struct{})
+	return int64(len(t.entries))
+}
+
+// length returns the number of entries of a topic.
+func (h *InmemHub) length(key string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.topic(key).entries)
+}
+
+// entry returns the entry of a topic at the supplied index (zero-based). If no
+// such entry exists yet, it returns a channel that will be closed when the
+// next entry is appended.
+func (h *InmemHub) entry(key string, idx int) (string, <-chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t := h.topic(key)
+	if idx < len(t.entries) {
+		return t.entries[idx], nil
+	}
+	return "", t.notify
+}
+
+// signal increments the counter of a state, releasing the waiters whose
+// target has been reached, and returns the new value.
+func (h *InmemHub) signal(key string) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.state(key)
+	s.count++
+
+	waiters := s.waiters[:0]
+	for _, w := range s.waiters {
+		if s.count >= w.target {
+			close(w.ch)
+			continue
+		}
+		waiters = append(waiters, w)
+	}
+	s.waiters = waiters
+
+	return s.count
+}
+
+// wait registers a waiter that is released when the state counter reaches
+// the target.
+func (h *InmemHub) wait(key string, target int64) *inmemWaiter {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	w := &inmemWaiter{target: target, ch: make(chan struct{})}
+	if s := h.state(key); s.count >= target {
+		close(w.ch)
+	} else {
+		s.waiters = append(s.waiters, w)
+	}
+	return w
+}
+
+// unwait removes a waiter that's no longer interested in its barrier.
+func (h *InmemHub) unwait(key string, w *inmemWaiter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.state(key)
+	for i, o := range s.waiters {
+		if o == w {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// InmemClient is a sync Client backed by an InmemHub instead of the sync
+// service. See NewInmemClient and InmemHub.
+type InmemClient struct {
 	*sugarOperations
 
-	states        map[State]int
-	barriers      map[State][]*Barrier
-	subscriptions map[string][]reflect.Value
-	published     map[string][]interface{}
+	hub       *InmemHub
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	extractor func(ctx context.Context) *runtime.RunParams
+	subs      subscriptionSet
+	closeOnce sync.Once
+}
+
+var _ Client = (*InmemClient)(nil)
+
+// NewInmemClient creates an in-memory sync client for testing, attached to a
+// hub of its own.
+//
+// Operations are scoped to the RunParams bound to the context through
+// WithRunParams, if any. Use an InmemHub to simulate multiple instances, each
+// bound to their own RunParams.
+func NewInmemClient() *InmemClient {
+	return newInmemClient(NewInmemHub(), func(ctx context.Context) *runtime.RunParams {
+		if rp := GetRunParams(ctx); rp != nil {
+			return rp
+		}
+		return &runtime.RunParams{}
+	})
 }
 
-// NewInmemClient creates an in-memory sync client for testing.
-func NewInmemClient() *inmemClient {
-	c := &inmemClient{
-		states:        make(map[State]int),
-		barriers:      make(map[State][]*Barrier),
-		subscriptions: make(map[string][]reflect.Value),
-		published:     make(map[string][]interface{}),
+func newInmemClient(hub *InmemHub, extractor func(ctx context.Context) *runtime.RunParams) *InmemClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &InmemClient{
+		hub:       hub,
+		ctx:       ctx,
+		cancel:    cancel,
+		extractor: extractor,
 	}
-	c.sugarOperations = &sugarOperations{c}
+	c.sugarOperations = &sugarOperations{Client: c, extractor: extractor}
 	return c
 }
 
+// scope returns a context that fires when either the supplied context or the
+// client's context fires.
+func (i *InmemClient) scope(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-i.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// checkContexts returns an error if either the supplied context or the
+// client's context have fired.
+func (i *InmemClient) checkContexts(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return i.ctx.Err()
+}
+
 // Elemental operations
 // ====================
 
-func (i *inmemClient) Publish(_ context.Context, topic *Topic, payload interface{}) (seq int64, err error) {
-	i.Lock()
-	defer i.Unlock()
+func (i *InmemClient) Publish(ctx context.Context, topic *Topic, payload interface{}) (seq int64, err error) {
+	rp := i.extractor(ctx)
+	if rp == nil {
+		return -1, ErrNoRunParameters
+	}
+
+	if err := i.checkContexts(ctx); err != nil {
+		return -1, err
+	}
 
-	p, ok := i.published[topic.name]
-	if !ok {
-		p = make([]interface{}, 0, 10)
+	if !topic.validatePayload(payload) {
+		err := fmt.Errorf("invalid payload type; expected: [*]%s, was: %T", topic.typ, payload)
+		return -1, err
 	}
-	p = append(p, payload)
-	i.published[topic.name] = p
 
-	for _, ch := range i.subscriptions[topic.name] {
-		ch.Send(reflect.ValueOf(payload))
+	encoded, err := topic.encodePayload(payload)
+	if err != nil {
+		return -1, err
 	}
 
-	return int64(len(p)), nil
+	return i.publish(topic.Key(rp), encoded)
 }
 
-func (i *inmemClient) Subscribe(_ context.Context, topic *Topic, ch interface{}) (*Subscription, error) {
-	i.Lock()
-	defer i.Unlock()
+func (i *InmemClient) publish(key string, payload interface{}) (int64, error) {
+	bytes, err := json.Marshal(payload)
+	if err != nil {
+		return -1, fmt.Errorf("failed while serializing payload: %w", err)
+	}
+	return i.hub.publish(key, string(bytes)), nil
+}
 
-	s, ok := i.subscriptions[topic.name]
-	if !ok {
-		s = make([]reflect.Value, 0, 10)
+func (i *InmemClient) Subscribe(ctx context.Context, topic *Topic, ch interface{}, opts ...SubscribeOption) (*Subscription, error) {
+	rp := i.extractor(ctx)
+	if rp == nil {
+		return nil, ErrNoRunParameters
 	}
-	chV := reflect.ValueOf(ch)
-	s = append(s, chV)
-	i.subscriptions[topic.name] = s
 
-	// replay any payloads for this topic.
-	for _, p := range i.published[topic.name] {
-		chV.Send(reflect.ValueOf(p))
+	key := topic.Key(rp)
+	sink, err := newSink(key, topic.typeValidator, ch, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.subscribe(ctx, key, sink)
+}
+
+func (i *InmemClient) subscribe(ctx context.Context, key string, sink *sink) (*Subscription, error) {
+	if err := i.checkContexts(ctx); err != nil {
+		return nil, err
 	}
 
-	return &Subscription{}, nil
+	// position the subscription at the first entry to deliver.
+	var start int
+	if sink.opts.startAt > 1 {
+		start = int(sink.opts.startAt - 1)
+	}
+	if sink.opts.tail {
+		if n := i.hub.length(key) - sink.opts.last; n > start {
+			start = n
+		}
+	}
+
+	ctx, cancel := i.scope(ctx)
+	sub := sink.subscription(cancel)
+	i.subs.add(sub)
+
+	i.wg.Add(2)
+	go func() {
+		defer i.wg.Done()
+
+		err := sink.run(ctx)
+		reason := ctx.Err()
+		if i.ctx.Err() != nil {
+			reason = ErrClientClosed
+		}
+		sub.finish(err, reason)
+	}()
+
+	go func() {
+		defer i.wg.Done()
+
+		for idx := start; ; {
+			entry, wait := i.hub.entry(key, idx)
+			if wait != nil {
+				select {
+				case <-wait:
+					continue
+				case <-ctx.Done():
+					return
+				case <-sink.done():
+					return
+				}
+			}
+			idx++
+
+			if !sink.push(ctx, int64(idx), entry) {
+				return
+			}
+		}
+	}()
+
+	return sub, nil
 }
 
-func (i *inmemClient) Barrier(_ context.Context, state State, target int) (*Barrier, error) {
-	b := &Barrier{
-		C:      make(chan error, 1),
-		target: int64(target),
+func (i *InmemClient) Barrier(ctx context.Context, state State, target int) (*Barrier, error) {
+	rp := i.extractor(ctx)
+	if rp == nil {
+		return nil, ErrNoRunParameters
 	}
 
-	i.Lock()
-	defer i.Unlock()
+	b := &Barrier{C: make(chan error, 1)}
 
-	if i.states[state] == target {
+	// a barrier with target zero is satisfied immediately, like DefaultClient
+	// does.
+	if target == 0 {
 		b.C <- nil
 		close(b.C)
 		return b, nil
 	}
 
-	barriers, ok := i.barriers[state]
-	if !ok {
-		barriers = make([]*Barrier, 0, 10)
+	if err := i.checkContexts(ctx); err != nil {
+		return nil, err
 	}
-	barriers = append(barriers, b)
-	i.barriers[state] = barriers
+
+	key := state.Key(rp)
+	w := i.hub.wait(key, int64(target))
+	ctx, cancel := i.scope(ctx)
+
+	i.wg.Add(1)
+	go func() {
+		defer i.wg.Done()
+		defer cancel()
+
+		select {
+		case <-w.ch:
+			b.C <- nil
+		case <-ctx.Done():
+			i.hub.unwait(key, w)
+			b.C <- ctx.Err()
+		}
+	}()
 
 	return b, nil
 }
 
-func (i *inmemClient) SignalEntry(_ context.Context, state State) (after int64, err error) {
-	i.Lock()
-	defer i.Unlock()
+func (i *InmemClient) SignalEntry(ctx context.Context, state State) (after int64, err error) {
+	rp := i.extractor(ctx)
+	if rp == nil {
+		return -1, ErrNoRunParameters
+	}
+
+	if err := i.checkContexts(ctx); err != nil {
+		return -1, err
+	}
+
+	return i.hub.signal(state.Key(rp)), nil
+}
+
+// SignalEvent emits an event attached to a certain test plan.
+func (i *InmemClient) SignalEvent(ctx context.Context, event *runtime.Event) error {
+	rp := i.extractor(ctx)
+	if rp == nil {
+		return ErrNoRunParameters
+	}
 
-	i.states[state]++
+	if err := i.checkContexts(ctx); err != nil {
+		return err
+	}
 
-	v := int64(i.states[state])
+	_, err := i.publish(eventsKey(rp), event)
+	return err
+}
 
-	var idx int
-	for _, b := range i.barriers[state] {
-		if v == b.target {
-			b.C <- nil
-			close(b.C)
-			continue
-		}
-		i.barriers[state][idx] = b
-		idx++
+// SubscribeEvents monitors the events signalled by all the instances of a run
+// through this hub.
+func (i *InmemClient) SubscribeEvents(ctx context.Context, rp *runtime.RunParams) (chan *runtime.Event, error) {
+	ch := make(chan *runtime.Event)
+	key := eventsKey(rp)
+	sink, err := newSink(key, eventsValidator, ch)
+	if err != nil {
+		return nil, err
 	}
 
-	i.barriers[state] = i.barriers[state][:idx]
+	if _, err = i.subscribe(ctx, key, sink); err != nil {
+		return nil, err
+	}
 
-	return v, nil
+	return ch, nil
 }
 
-func (i *inmemClient) SignalEvent(_ context.Context, event *runtime.Event) error {
-	return nil
+// Subscriptions returns the active subscriptions of this client, oldest
+// first.
+func (i *InmemClient) Subscriptions() []*Subscription {
+	return i.subs.list()
 }
 
-func (i *inmemClient) Close() error {
+// Close closes this client, cancelling all its ongoing subscriptions and
+// barriers. Data published to the hub is retained. Calling Close more than
+// once is a no-op.
+func (i *InmemClient) Close() error {
+	i.closeOnce.Do(func() {
+		i.subs.warnActive(zap.S())
+		i.cancel()
+		i.wg.Wait()
+	})
 	return nil
 }
@@ -0,0 +1,122 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/testground/sdk-go/runtime"
+)
+
+func TestInmemHubMultipleInstances(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var (
+		hub   = NewInmemHub()
+		rp    = &runtime.RunParams{TestRun: "run", TestPlan: "plan", TestCase: "case"}
+		other = &runtime.RunParams{TestRun: "other", TestPlan: "plan", TestCase: "case"}
+		a     = hub.NewBoundClient(rp)
+		b     = hub.NewBoundClient(rp)
+		c     = hub.NewBoundClient(other)
+		topic = NewTopic("peers", "")
+		state = State("ready")
+	)
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+
+	a.MustPublish(ctx, topic, "a")
+	b.MustPublish(ctx, topic, "b")
+	c.MustPublish(ctx, topic, "c")
+
+	ch := make(chan string, 1)
+	sub := b.MustSubscribe(ctx, topic, ch)
+	require.Equal(t, "a", <-ch)
+	require.Equal(t, "b", <-ch)
+
+	// the entry published under other RunParams is not visible.
+	select {
+	case v := <-ch:
+		t.Fatalf("unexpected entry: %s", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	barrier := a.MustBarrier(ctx, state, 2)
+	require.EqualValues(t, 1, b.MustSignalEntry(ctx, state))
+	require.EqualValues(t, 1, c.MustSignalEntry(ctx, state))
+	require.EqualValues(t, 2, a.MustSignalEntry(ctx, state))
+	require.NoError(t, <-barrier.C)
+
+	// closing the client terminates its subscriptions.
+	require.NoError(t, b.Close())
+	select {
+	case err := <-sub.Done():
+		require.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal("subscription not terminated on close")
+	}
+}
+
+func TestInmemCancellation(t *testing.T) {
+	client := NewInmemHub().NewBoundClient(&runtime.RunParams{TestRun: "run"})
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// an unbuffered channel nobody consumes from must not wedge the hub.
+	sub := client.MustSubscribe(ctx, NewTopic("t", 0), make(chan int))
+	client.MustPublish(context.Background(), NewTopic("t", 0), 1)
+	client.MustPublish(context.Background(), NewTopic("t", 0), 2)
+
+	b := client.MustBarrier(ctx, "never", 10)
+	cancel()
+
+	require.True(t, errors.Is(<-b.C, context.Canceled))
+	require.NoError(t, <-sub.Done())
+
+	_, err := client.Publish(ctx, NewTopic("t", 0), 3)
+	require.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestInmemBarrierTargetZero(t *testing.T) {
+	client := NewInmemClient()
+	require.NoError(t, client.Close())
+	require.NoError(t, client.Close(), "closing twice must be a no-op")
+
+	// generic clients without RunParams fail before anything else.
+	generic := NewInmemHub().NewGenericClient()
+	defer generic.Close()
+	_, err := generic.Barrier(context.Background(), "ready", 0)
+	require.True(t, errors.Is(err, ErrNoRunParameters), err)
+
+	ctx := WithRunParams(context.Background(), &runtime.RunParams{TestRun: "run"})
+	b, err := generic.Barrier(ctx, "ready", 0)
+	require.NoError(t, err)
+	require.NoError(t, <-b.C)
+	_, ok := <-b.C
+	require.False(t, ok, "the barrier channel must be closed")
+}
+
+func TestInmemEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var (
+		hub      = NewInmemHub()
+		rp       = &runtime.RunParams{TestRun: "run", TestGroupID: "group"}
+		instance = hub.NewBoundClient(rp)
+		monitor  = hub.NewGenericClient()
+	)
+	defer instance.Close()
+	defer monitor.Close()
+
+	events, err := monitor.SubscribeEvents(ctx, rp)
+	require.NoError(t, err)
+
+	evt := &runtime.Event{SuccessEvent: &runtime.SuccessEvent{TestGroupID: "group"}}
+	require.NoError(t, instance.SignalEvent(ctx, evt))
+	require.Equal(t, evt, <-events)
+}
@@ -0,0 +1,253 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/testground/sdk-go/runtime"
+	"go.uber.org/zap"
+)
+
+// ErrInjectedFault is returned by the requests failed by a FaultInjector.
+var ErrInjectedFault = errors.New("injected fault")
+
+// Call describes an invocation of an elemental operation of a Client. Only
+// the fields relevant to the operation are set.
+type Call struct {
+	// Op is one of the Op* constants.
+	Op string
+
+	Topic *Topic
+	// Payload is the payload to publish, or the event to signal.
+	Payload  interface{}
+	Payloads []interface{}
+	// Ch and Opts are the arguments to Subscribe.
+	Ch   interface{}
+	Opts []SubscribeOption
+
+	State  State
+	Target int
+}
+
+// Result holds the results of an invocation of an elemental operation of a
+// Client. Only the fields relevant to the operation are set.
+type Result struct {
+	// Seq is the sequence number returned by Publish and SignalEntry.
+	Seq          int64
+	Seqs         []int64
+	Subscription *Subscription
+	Barrier      *Barrier
+}
+
+// Invoker invokes an elemental operation of a Client.
+type Invoker func(ctx context.Context, call *Call) (*Result, error)
+
+// Interceptor intercepts the invocations of the elemental operations of a
+// Client, and calls next to proceed with the invocation, possibly modifying
+// the call, the context or the result, or not calling it at all.
+type Interceptor func(ctx context.Context, call *Call, next Invoker) (*Result, error)
+
+// interceptedClient applies a chain of interceptors to a Client.
+type interceptedClient struct {
+	*sugarOperations
+
+	inner  Client
+	invoke Invoker
+}
+
+var _ Client = (*interceptedClient)(nil)
+
+// WithInterceptors returns a Client that passes every invocation of an
+// elemental operation of the supplied Client (Publish, PublishBatch,
+// Subscribe, Barrier, SignalEntry and SignalEvent) through the chain of
+// interceptors, the first one being the outermost. The sugar methods, being
+// built on the elemental operations, are intercepted as well.
+//
+// Closing the returned Client closes the supplied one.
+func WithInterceptors(client Client, interceptors ...Interceptor) Client {
+	invoke := func(ctx context.Context, call *Call) (*Result, error) {
+		return invokeClient(ctx, client, call)
+	}
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoke
+		invoke = func(ctx context.Context, call *Call) (*Result, error) {
+			return interceptor(ctx, call, next)
+		}
+	}
+
+	c := &interceptedClient{inner: client, invoke: invoke}
+	c.sugarOperations = &sugarOperations{Client: c, extractor: GetRunParams}
+	if s, ok := client.(interface{ sugar() *sugarOperations }); ok {
+		// inherit the binding of the supplied client.
+		c.sugarOperations.extractor = s.sugar().extractor
+		c.sugarOperations.runenv = s.sugar().runenv
+		c.sugarOperations.log = s.sugar().log
+	}
+	return c
+}
+
+// sugar exposes the sugarOperations embedded by a Client.
+func (c *sugarOperations) sugar() *sugarOperations {
+	return c
+}
+
+// invokeClient performs a call on a Client.
+func invokeClient(ctx context.Context, client Client, call *Call) (res *Result, err error) {
+	res = new(Result)
+	switch call.Op {
+	case OpPublish:
+		res.Seq, err = client.Publish(ctx, call.Topic, call.Payload)
+	case OpPublishBatch:
+		res.Seqs, err = client.PublishBatch(ctx, call.Topic, call.Payloads)
+	case OpSubscribe:
+		res.Subscription, err = client.Subscribe(ctx, call.Topic, call.Ch, call.Opts...)
+	case OpBarrier:
+		res.Barrier, err = client.Barrier(ctx, call.State, call.Target)
+	case OpSignalEntry:
+		res.Seq, err = client.SignalEntry(ctx, call.State)
+	case OpSignalEvent:
+		event, _ := call.Payload.(*runtime.Event)
+		err = client.SignalEvent(ctx, event)
+	default:
+		err = errors.New("unknown operation: " + call.Op)
+	}
+	return res, err
+}
+
+func (c *interceptedClient) Publish(ctx context.Context, topic *Topic, payload interface{}) (int64, error) {
+	res, err := c.invoke(ctx, &Call{Op: OpPublish, Topic: topic, Payload: payload})
+	if err != nil {
+		return -1, err
+	}
+	return res.Seq, nil
+}
+
+func (c *interceptedClient) PublishBatch(ctx context.Context, topic *Topic, payloads []interface{}) ([]int64, error) {
+	res, err := c.invoke(ctx, &Call{Op: OpPublishBatch, Topic: topic, Payloads: payloads})
+	if err != nil {
+		return nil, err
+	}
+	return res.Seqs, nil
+}
+
+func (c *interceptedClient) Subscribe(ctx context.Context, topic *Topic, ch interface{}, opts ...SubscribeOption) (*Subscription, error) {
+	res, err := c.invoke(ctx, &Call{Op: OpSubscribe, Topic: topic, Ch: ch, Opts: opts})
+	if err != nil {
+		return nil, err
+	}
+	return res.Subscription, nil
+}
+
+func (c *interceptedClient) Barrier(ctx context.Context, state State, target int) (*Barrier, error) {
+	res, err := c.invoke(ctx, &Call{Op: OpBarrier, State: state, Target: target})
+	if err != nil {
+		return nil, err
+	}
+	return res.Barrier, nil
+}
+
+func (c *interceptedClient) SignalEntry(ctx context.Context, state State) (int64, error) {
+	res, err := c.invoke(ctx, &Call{Op: OpSignalEntry, State: state})
+	if err != nil {
+		return -1, err
+	}
+	return res.Seq, nil
+}
+
+func (c *interceptedClient) SignalEvent(ctx context.Context, event *runtime.Event) error {
+	_, err := c.invoke(ctx, &Call{Op: OpSignalEvent, Payload: event})
+	return err
+}
+
+// Subscriptions returns the active subscriptions of the intercepted client.
+func (c *interceptedClient) Subscriptions() []*Subscription {
+	return c.inner.Subscriptions()
+}
+
+// Close closes the intercepted client.
+func (c *interceptedClient) Close() error {
+	return c.inner.Close()
+}
+
+// LoggingInterceptor logs every call at debug level, along with its duration
+// and outcome. Failed calls are logged at warn level.
+func LoggingInterceptor(log *zap.SugaredLogger) Interceptor {
+	return func(ctx context.Context, call *Call, next Invoker) (*Result, error) {
+		start := time.Now()
+		res, err := next(ctx, call)
+
+		kv := []interface{}{"op", call.Op, "took", time.Since(start)}
+		switch {
+		case call.Topic != nil:
+			kv = append(kv, "topic", call.Topic.name)
+		case call.State != "":
+			kv = append(kv, "state", call.State, "target", call.Target)
+		}
+		if call.Payload != nil {
+			kv = append(kv, "payload", call.Payload)
+		}
+
+		if err != nil {
+			log.Warnw("sync call failed", append(kv, "error", err)...)
+		} else {
+			log.Debugw("sync call", kv...)
+		}
+		return res, err
+	}
+}
+
+// FaultInjector configures the faults injected by a FaultInjectionInterceptor.
+type FaultInjector struct {
+	// Ops are the operations subject to faults; all if empty.
+	Ops []string
+	// FailureRate is the probability, between 0 and 1, of a call failing
+	// with ErrInjectedFault, without reaching the client.
+	FailureRate float64
+	// Delay and Jitter delay calls by Delay, plus a random duration up to
+	// Jitter, before proceeding.
+	Delay  time.Duration
+	Jitter time.Duration
+	// Seed seeds the random source, for reproducible faults.
+	Seed int64
+}
+
+// FaultInjectionInterceptor fails and delays calls as configured.
+func FaultInjectionInterceptor(f FaultInjector) Interceptor {
+	var (
+		mu  sync.Mutex
+		rnd = rand.New(rand.NewSource(f.Seed))
+		ops = make(map[string]bool, len(f.Ops))
+	)
+	for _, op := range f.Ops {
+		ops[op] = true
+	}
+
+	return func(ctx context.Context, call *Call, next Invoker) (*Result, error) {
+		if len(ops) > 0 && !ops[call.Op] {
+			return next(ctx, call)
+		}
+
+		mu.Lock()
+		fail := rnd.Float64() < f.FailureRate
+		delay := f.Delay
+		if f.Jitter > 0 {
+			delay += time.Duration(rnd.Int63n(int64(f.Jitter)))
+		}
+		mu.Unlock()
+
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if fail {
+			return nil, ErrInjectedFault
+		}
+		return next(ctx, call)
+	}
+}
@@ -0,0 +1,57 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/testground/sdk-go/runtime"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestInterceptors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	inner := NewInmemHub().NewBoundClient(&runtime.RunParams{TestRun: "run"})
+
+	var calls []string
+	tracer := func(name string) Interceptor {
+		return func(ctx context.Context, call *Call, next Invoker) (*Result, error) {
+			calls = append(calls, name+":"+call.Op)
+			return next(ctx, call)
+		}
+	}
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	client := WithInterceptors(inner, tracer("outer"), tracer("inner"), LoggingInterceptor(zap.New(core).Sugar()))
+	defer client.Close()
+
+	// sugar methods go through the chain too.
+	_, err := client.SignalAndWait(ctx, "ready", 1)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"outer:signal_entry", "inner:signal_entry",
+		"outer:barrier", "inner:barrier",
+	}, calls)
+	require.Equal(t, 2, logs.FilterMessage("sync call").Len())
+
+	faulty := WithInterceptors(inner, FaultInjectionInterceptor(FaultInjector{
+		Ops:         []string{OpPublish},
+		FailureRate: 1,
+		Delay:       10 * time.Millisecond,
+	}))
+
+	start := time.Now()
+	_, err = faulty.Publish(ctx, NewTopic("t", ""), "x")
+	require.True(t, errors.Is(err, ErrInjectedFault), err)
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(10*time.Millisecond))
+
+	// other operations are unaffected.
+	_, err = faulty.SignalEntry(ctx, "ready")
+	require.NoError(t, err)
+}
@@ -0,0 +1,189 @@
+package sync
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/testground/sdk-go/runtime"
+)
+
+// Names of the diagnostics metrics, in RunEnv.D(), where bound and shared
+// clients record the latency of the operations they perform against the sync
+// service. Metrics are tagged with the operation: publish, publish_batch,
+// barrier, signal_entry, or subscribe.
+const (
+	// RequestDurationTimer times requests, from the moment they're issued
+	// until the response arrives. For barriers, that's the whole wait.
+	RequestDurationTimer = "sync.request.duration"
+	// RequestsInFlightGauge counts the requests awaiting a response, and the
+	// active subscriptions, of all the open clients bound to the RunEnv.
+	RequestsInFlightGauge = "sync.requests.in_flight"
+	// DeliveryLagTimer times the stay of entries in the local buffer of a
+	// subscription: from the moment the client receives them from the sync
+	// service, until they're sent on the subscriber's channel. It includes
+	// the time spent waiting for the subscriber to make room in its channel,
+	// but not the transit from the sync service, nor the time entries then
+	// sit in the channel until they're read.
+	DeliveryLagTimer = "sync.subscribe.delivery_lag"
+)
+
+var ops = []string{OpPublish, OpPublishBatch, OpBarrier, OpSignalEntry, OpSubscribe}
+
+// Prometheus collectors, exposed by the /metrics endpoint of the test plan.
+// They aggregate all DefaultClients in the process.
+var (
+	promRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "testground",
+		Subsystem: "sync",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of requests to the sync service, by operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"op"})
+
+	promRequestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "testground",
+		Subsystem: "sync",
+		Name:      "requests_in_flight",
+		Help:      "Requests to the sync service awaiting a response, and active subscriptions, by operation.",
+	}, []string{"op"})
+
+	promDeliveryLag = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "testground",
+		Subsystem: "sync",
+		Name:      "delivery_lag_seconds",
+		Help:      "Time spent by subscription entries in the local buffer, until sent on the subscriber's channel.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(promRequestDuration, promRequestsInFlight, promDeliveryLag)
+}
+
+// instruments records the metrics of a DefaultClient.
+type instruments struct {
+	inflight map[string]*int64
+
+	// only set for clients with a RunEnv.
+	timers map[string]runtime.Timer
+	lag    runtime.Timer
+	gauges *inflightGauges
+}
+
+// inflightGauges backs the in-flight gauges of a RunEnv, which sum the
+// in-flight counts of the live instruments bound to it. Diagnostics metrics
+// are registered once per name, so the gauges can't be per client.
+type inflightGauges struct {
+	mu   sync.Mutex
+	live map[*instruments]struct{}
+}
+
+// gauges holds the in-flight gauges of every RunEnv that instruments were
+// bound to. Entries are never removed, as the gauges remain registered.
+var gauges = struct {
+	sync.Mutex
+	m map[*runtime.RunEnv]*inflightGauges
+}{m: make(map[*runtime.RunEnv]*inflightGauges)}
+
+// gaugesFor returns the in-flight gauges of the RunEnv, registering them on
+// first use.
+func gaugesFor(runenv *runtime.RunEnv) *inflightGauges {
+	gauges.Lock()
+	defer gauges.Unlock()
+
+	if g, ok := gauges.m[runenv]; ok {
+		return g
+	}
+	g := &inflightGauges{live: make(map[*instruments]struct{})}
+	for _, op := range ops {
+		op := op
+		runenv.D().GaugeF(fmt.Sprintf("%s,op=%s", RequestsInFlightGauge, op), func() float64 {
+			return g.sum(op)
+		})
+	}
+	gauges.m[runenv] = g
+	return g
+}
+
+// sum returns the in-flight count of op across the live instruments.
+func (g *inflightGauges) sum(op string) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var n int64
+	for in := range g.live {
+		n += atomic.LoadInt64(in.inflight[op])
+	}
+	return float64(n)
+}
+
+func newInstruments(runenv *runtime.RunEnv) *instruments {
+	in := &instruments{inflight: make(map[string]*int64, len(ops))}
+	for _, op := range ops {
+		in.inflight[op] = new(int64)
+	}
+
+	if runenv == nil {
+		return in
+	}
+
+	in.timers = make(map[string]runtime.Timer, len(ops))
+	for _, op := range ops {
+		if op != OpSubscribe {
+			in.timers[op] = runenv.D().Timer(fmt.Sprintf("%s,op=%s", RequestDurationTimer, op))
+		}
+	}
+	in.lag = runenv.D().Timer(DeliveryLagTimer)
+
+	in.gauges = gaugesFor(runenv)
+	in.gauges.mu.Lock()
+	in.gauges.live[in] = struct{}{}
+	in.gauges.mu.Unlock()
+	return in
+}
+
+// release stops counting these instruments in the in-flight gauges of their
+// RunEnv. It is called when the client they belong to is closed.
+func (in *instruments) release() {
+	if in.gauges == nil {
+		return
+	}
+	in.gauges.mu.Lock()
+	delete(in.gauges.live, in)
+	in.gauges.mu.Unlock()
+}
+
+// track counts an operation as in flight until done is called.
+func (in *instruments) track(op string) (done func()) {
+	atomic.AddInt64(in.inflight[op], 1)
+	promRequestsInFlight.WithLabelValues(op).Inc()
+	return func() {
+		atomic.AddInt64(in.inflight[op], -1)
+		promRequestsInFlight.WithLabelValues(op).Dec()
+	}
+}
+
+// observe tracks an operation, and times it until done is called.
+func (in *instruments) observe(op string) (done func()) {
+	start := time.Now()
+	untrack := in.track(op)
+	return func() {
+		untrack()
+		d := time.Since(start)
+		promRequestDuration.WithLabelValues(op).Observe(d.Seconds())
+		if t := in.timers[op]; t != nil {
+			t.Update(d)
+		}
+	}
+}
+
+// observeLag records the time taken to deliver an entry to a subscriber.
+func (in *instruments) observeLag(d time.Duration) {
+	promDeliveryLag.Observe(d.Seconds())
+	if in.lag != nil {
+		in.lag.Update(d)
+	}
+}
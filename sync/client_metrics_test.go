@@ -0,0 +1,86 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/testground/sdk-go/runtime"
+)
+
+func TestClientMetrics(t *testing.T) {
+	startSyncService(t)
+
+	runenv, cleanup := runtime.RandomTestRunEnv(t)
+	t.Cleanup(cleanup)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := NewBoundClient(ctx, runenv)
+	require.NoError(t, err)
+	defer client.Close()
+
+	before := testutil.ToFloat64(promRequestsInFlight.WithLabelValues(OpSubscribe))
+
+	topic := NewTopic("metrics", "")
+	client.MustPublish(ctx, topic, "a")
+	client.MustSignalAndWait(ctx, "metrics", 1)
+
+	sctx, scancel := context.WithCancel(ctx)
+	ch := make(chan string, 1)
+	sub := client.MustSubscribe(sctx, topic, ch)
+	<-ch
+
+	timer := func(op string) int64 {
+		return runenv.D().Timer(fmt.Sprintf("%s,op=%s", RequestDurationTimer, op)).Count()
+	}
+	require.EqualValues(t, 1, timer(OpPublish))
+	require.EqualValues(t, 1, timer(OpSignalEntry))
+	require.EqualValues(t, 1, timer(OpBarrier))
+	require.EqualValues(t, 1, runenv.D().Timer(DeliveryLagTimer).Count())
+
+	inflight := runenv.D().GaugeF(fmt.Sprintf("%s,op=%s", RequestsInFlightGauge, OpSubscribe), nil)
+	require.EqualValues(t, 1, inflight.Value())
+	require.EqualValues(t, before+1, testutil.ToFloat64(promRequestsInFlight.WithLabelValues(OpSubscribe)))
+
+	scancel()
+	<-sub.Done()
+	require.EqualValues(t, 0, inflight.Value())
+	require.EqualValues(t, before, testutil.ToFloat64(promRequestsInFlight.WithLabelValues(OpSubscribe)))
+}
+
+func TestClientMetricsInFlightSharedRunEnv(t *testing.T) {
+	startSyncService(t)
+
+	runenv, cleanup := runtime.RandomTestRunEnv(t)
+	t.Cleanup(cleanup)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	a, err := NewBoundClient(ctx, runenv)
+	require.NoError(t, err)
+	defer a.Close()
+
+	b := MustSharedClient(ctx, runenv)
+	defer b.Close()
+
+	topic := NewTopic("metrics-inflight", "")
+	a.MustSubscribe(ctx, topic, make(chan string))
+	sb := b.MustSubscribe(ctx, topic, make(chan string))
+
+	// the gauge sums the subscriptions of both clients.
+	inflight := runenv.D().GaugeF(fmt.Sprintf("%s,op=%s", RequestsInFlightGauge, OpSubscribe), nil)
+	require.EqualValues(t, 2, inflight.Value())
+
+	require.NoError(t, a.Close())
+	require.EqualValues(t, 1, inflight.Value())
+
+	sb.Cancel()
+	<-sb.Done()
+	require.EqualValues(t, 0, inflight.Value())
+}
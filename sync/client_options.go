@@ -0,0 +1,201 @@
+package sync
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/testground/sdk-go/runtime"
+	"go.uber.org/zap"
+)
+
+// DefaultReadTimeout is how long a DefaultClient waits without receiving
+// anything from the sync service before considering the connection lost. It
+// matches the timeout that the sync service applies on its side by default;
+// see ClientOptions.ReadTimeout.
+const DefaultReadTimeout = time.Hour
+
+// AuthHeader is the HTTP header carrying the auth token of websocket
+// transports, as a bearer token.
+const AuthHeader = "Authorization"
+
+// ClientOptions configures a DefaultClient. The zero value connects to the sync
+// service at the address given by the environment, like NewBoundClient.
+type ClientOptions struct {
+	// Address is the address of the sync service, as a URL whose scheme
+	// selects the transport; see DialerFor. If empty, the address is taken
+	// from the SYNC_SERVICE_HOST and SYNC_SERVICE_PORT environment variables.
+	Address string
+	// DialTimeout bounds every attempt to connect to the sync service,
+	// including reconnections. Zero means no timeout.
+	DialTimeout time.Duration
+	// TLS configures the TLS connection of wss://, tcp:// and rediss://
+	// addresses. It is required for tcp:// addresses to use TLS.
+	TLS *tls.Config
+	// AuthToken, if set, authenticates the client: it is sent as a bearer
+	// token in the AuthHeader of websocket transports, and as the password of
+	// Redis transports. The tcp:// transport does not support it.
+	AuthToken string
+	// ReadTimeout is how long to wait without receiving anything from the
+	// sync service before considering the connection lost, and reconnecting.
+	// Zero means DefaultReadTimeout.
+	//
+	// The sync service drops connections idle for as long as its own timeout,
+	// and sends nothing to idle clients. A longer ReadTimeout is only useful
+	// if the service is configured alike; a shorter one makes idle clients
+	// reconnect every ReadTimeout, replaying their pending requests.
+	ReadTimeout time.Duration
+	// Logger is the logger of the client. If nil, the RunEnv logger is used
+	// by bound clients, and the global zap logger by generic clients.
+	Logger *zap.SugaredLogger
+}
+
+// Validate checks the options for consistency, returning an error describing
+// every problem found.
+func (o *ClientOptions) Validate() error {
+	var merr *multierror.Error
+
+	if o.DialTimeout < 0 {
+		merr = multierror.Append(merr, fmt.Errorf("negative dial timeout: %s", o.DialTimeout))
+	}
+	if o.ReadTimeout < 0 {
+		merr = multierror.Append(merr, fmt.Errorf("negative read timeout: %s", o.ReadTimeout))
+	}
+
+	addr, err := o.address()
+	if err != nil {
+		return multierror.Append(merr, err).ErrorOrNil()
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return multierror.Append(merr, fmt.Errorf("invalid sync service address %q: %w", addr, err)).ErrorOrNil()
+	}
+	if u.Host == "" {
+		merr = multierror.Append(merr, fmt.Errorf("invalid sync service address %q: missing host", addr))
+	}
+
+	switch u.Scheme {
+	case "ws", "redis":
+		if o.TLS != nil {
+			merr = multierror.Append(merr, fmt.Errorf("TLS configuration supplied for insecure address %q", addr))
+		}
+	case "wss", "rediss":
+	case "tcp":
+		if o.AuthToken != "" {
+			merr = multierror.Append(merr, errors.New("the tcp:// transport does not support auth tokens"))
+		}
+	default:
+		merr = multierror.Append(merr, fmt.Errorf("unsupported scheme in sync service address %q", addr))
+	}
+
+	return merr.ErrorOrNil()
+}
+
+// address returns the configured address, or the one given by the
+// environment.
+func (o *ClientOptions) address() (string, error) {
+	if o.Address != "" {
+		return o.Address, nil
+	}
+	return socketAddress()
+}
+
+// dialer returns the Dialer of the configured transport. The options must have
+// been validated.
+func (o *ClientOptions) dialer() (Dialer, error) {
+	addr, err := o.address()
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var dial Dialer
+	switch u.Scheme {
+	case "ws", "wss":
+		var header http.Header
+		if o.AuthToken != "" {
+			header = http.Header{AuthHeader: []string{"Bearer " + o.AuthToken}}
+		}
+		dial = webSocketDialer(addr, o.TLS, header)
+	case "tcp":
+		dial = TCPDialer(u.Host, o.TLS)
+	case "redis", "rediss":
+		dial = redisDialer(addr, o.TLS, o.AuthToken)
+	default:
+		return nil, fmt.Errorf("unsupported scheme in sync service address %q", addr)
+	}
+
+	if timeout := o.DialTimeout; timeout > 0 {
+		inner := dial
+		dial = func(ctx context.Context) (Transport, error) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return inner(ctx)
+		}
+	}
+	return dial, nil
+}
+
+// NewBoundClientWithOptions is like NewBoundClient, but configured through the
+// supplied options, which are validated first.
+func NewBoundClientWithOptions(ctx context.Context, runenv *runtime.RunEnv, opts ClientOptions) (*DefaultClient, error) {
+	if opts.Logger == nil {
+		opts.Logger = runenv.SLogger()
+	}
+	return newClientWithOptions(ctx, func(ctx context.Context) *runtime.RunParams {
+		return &runenv.RunParams
+	}, runenv, opts)
+}
+
+// MustBoundClientWithOptions calls NewBoundClientWithOptions, panicking if it
+// errors.
+func MustBoundClientWithOptions(ctx context.Context, runenv *runtime.RunEnv, opts ClientOptions) *DefaultClient {
+	c, err := NewBoundClientWithOptions(ctx, runenv, opts)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// NewGenericClientWithOptions is like NewGenericClient, but configured through
+// the supplied options, which are validated first.
+func NewGenericClientWithOptions(ctx context.Context, opts ClientOptions) (*DefaultClient, error) {
+	if opts.Logger == nil {
+		opts.Logger = zap.S()
+	}
+	return newClientWithOptions(ctx, GetRunParams, nil, opts)
+}
+
+// MustGenericClientWithOptions calls NewGenericClientWithOptions, panicking if
+// it errors.
+func MustGenericClientWithOptions(ctx context.Context, opts ClientOptions) *DefaultClient {
+	c, err := NewGenericClientWithOptions(ctx, opts)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func newClientWithOptions(ctx context.Context, extractor func(ctx context.Context) *runtime.RunParams, runenv *runtime.RunEnv, opts ClientOptions) (*DefaultClient, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid sync client options: %w", err)
+	}
+	dial, err := opts.dialer()
+	if err != nil {
+		return nil, err
+	}
+
+	readTimeout := opts.ReadTimeout
+	if readTimeout == 0 {
+		readTimeout = DefaultReadTimeout
+	}
+	return newClientWithDialer(ctx, opts.Logger, extractor, runenv, dial, readTimeout)
+}
@@ -0,0 +1,91 @@
+package sync
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/testground/sdk-go/runtime"
+	"github.com/testground/sdk-go/sync/synctest"
+)
+
+func TestClientOptionsValidate(t *testing.T) {
+	opts := ClientOptions{
+		Address:     "ws://localhost:5050",
+		TLS:         &tls.Config{},
+		DialTimeout: -time.Second,
+	}
+	err := opts.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "negative dial timeout")
+	require.Contains(t, err.Error(), "insecure address")
+
+	for _, opts := range []ClientOptions{
+		{Address: "http://localhost:5050"},
+		{Address: "tcp://localhost:5050", AuthToken: "secret"},
+		{Address: "ws://"},
+		{Address: "wss://localhost:5050", ReadTimeout: -time.Second},
+	} {
+		require.Error(t, opts.Validate(), opts.Address)
+	}
+
+	require.NoError(t, (&ClientOptions{Address: "tcp://localhost:5050", TLS: &tls.Config{}}).Validate())
+
+	// invalid environment variables are reported, not replaced by defaults.
+	t.Setenv(EnvServicePort, "http")
+	err = (&ClientOptions{}).Validate()
+	require.Error(t, err)
+	require.True(t, strings.Contains(err.Error(), EnvServicePort), err)
+}
+
+func TestSocketAddress(t *testing.T) {
+	t.Setenv(EnvServicePort, "5050")
+
+	for host, addr := range map[string]string{
+		"":                   "ws://testground-sync-service:5050",
+		"sync_service.local": "ws://sync_service.local:5050",
+		"10.0.0.1":           "ws://10.0.0.1:5050",
+		"fd00::1":            "ws://[fd00::1]:5050",
+		"[::1]":              "ws://[::1]:5050",
+	} {
+		t.Setenv(EnvServiceHost, host)
+		got, err := socketAddress()
+		require.NoError(t, err, host)
+		require.Equal(t, addr, got)
+	}
+
+	for _, host := range []string{"sync:5050", "user@sync", "sync/path", "-sync", "sync..local", "[sync]"} {
+		t.Setenv(EnvServiceHost, host)
+		_, err := socketAddress()
+		require.Error(t, err, host)
+	}
+}
+
+func TestClientOptionsAuthToken(t *testing.T) {
+	srv := synctest.NewTLSServer()
+	srv.AuthToken = "secret"
+	defer srv.Close()
+
+	runenv, cleanup := runtime.RandomTestRunEnv(t)
+	t.Cleanup(cleanup)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := ClientOptions{
+		Address:     srv.Addr(),
+		TLS:         srv.ClientTLSConfig(),
+		DialTimeout: 5 * time.Second,
+		ReadTimeout: time.Minute,
+	}
+	_, err := NewBoundClientWithOptions(ctx, runenv, opts)
+	require.Error(t, err)
+
+	opts.AuthToken = "secret"
+	client := MustBoundClientWithOptions(ctx, runenv, opts)
+	defer client.Close()
+	require.EqualValues(t, 1, client.MustSignalEntry(ctx, "authenticated"))
+}
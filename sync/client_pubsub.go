@@ -3,12 +3,13 @@ package sync
 import (
 	"context"
 	"errors"
-	"reflect"
 
 	sync "github.com/testground/sync-service"
 )
 
 func (c *DefaultClient) publish(ctx context.Context, topic string, payload interface{}) (int64, error) {
+	defer c.metricsFor(ctx).observe(OpPublish)()
+
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
@@ -26,14 +27,15 @@ func (c *DefaultClient) publish(ctx context.Context, topic string, payload inter
 	if !ok {
 		return -1, errors.New("channel closed before getting response")
 	}
-	if res.Error != "" {
-		return -1, errors.New(res.Error)
+	if err := responseError(res); err != nil {
+		return -1, err
 	}
 
+	c.logFor(ctx).Debugw("successfully published item; sequence number obtained", "key", topic, "id", res.ID, "seq", res.PublishResponse.Seq)
 	return int64(res.PublishResponse.Seq), nil
 }
 
-func (c *DefaultClient) subscribe(ctx context.Context, key string, deref bool, val *typeValidator, ch interface{}) (sub *Subscription, err error) {
+func (c *DefaultClient) subscribe(ctx context.Context, key string, sink *sink) (sub *Subscription, err error) {
 	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
@@ -42,26 +44,12 @@ func (c *DefaultClient) subscribe(ctx context.Context, key string, deref bool, v
 		return nil, err
 	}
 
-	ctx, cancel := context.WithCancel(ctx)
-
-	// sendFn is a closure that sends an element into the supplied ch,
-	// performing necessary pointer to value conversions if necessary.
-	//
-	// sendFn will block if the receiver is not consuming from the channel.
-	// If the context is closed, the send will be aborted, and the closure will
-	// return a false value.
-	sendFn := func(v reflect.Value) (sent bool) {
-		if deref {
-			v = v.Elem()
-		}
-		cases := []reflect.SelectCase{
-			{Dir: reflect.SelectSend, Chan: reflect.ValueOf(ch), Send: v},
-			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
-		}
-		_, _, ctxFired := reflect.Select(cases)
-		return !ctxFired
+	if sink.opts.tail {
+		return nil, ErrTailUnsupported
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+
 	req := &sync.Request{
 		SubscribeRequest: &sync.SubscribeRequest{
 			Topic: key,
@@ -74,48 +62,73 @@ func (c *DefaultClient) subscribe(ctx context.Context, key string, deref bool, v
 		return nil, err
 	}
 
-	sub = &Subscription{make(chan error, 1)}
+	log, metrics := c.logFor(ctx), c.metricsFor(ctx)
+	sub = sink.subscription(cancel)
+	c.subs.add(sub)
+	sink.log = log
+	sink.delivered = metrics.observeLag
+	if runenv := c.runenvFor(ctx); runenv != nil {
+		if sink.opts.decodeErrors == nil {
+			sink.opts.decodeErrors = runenv.D().Counter(DecodeErrorsCounter)
+		}
+		sink.opts.dropped = runenv.D().Counter(DroppedEntriesCounter)
+	}
 
+	// deliver the entries on a goroutine of their own, so that a slow
+	// subscriber doesn't hold up the responsesWorker; see WithBuffer.
+	untrack := metrics.track(OpSubscribe)
 	go func() {
 		defer cancel()
 
+		err := sink.run(ctx)
+		reason := ctx.Err()
+		if c.ctx.Err() != nil {
+			reason = ErrClientClosed
+			if c.isDraining() {
+				reason = ErrClientShutdown
+			}
+		} else if b := bindingOf(ctx); b != nil && b.closed() {
+			reason = ErrClientClosed
+		}
+		if err == nil && reason != nil {
+			log.Debugw("context was closed when dispatching message to subscriber; rm subscription", "key", key, "id", req.ID)
+		}
+		untrack()
+		sub.finish(err, reason)
+	}()
+
+	go func() {
+		dispatch := func(seq int64, raw string) bool {
+			log.Debugw("dispatching message to subscriber", "key", key, "id", req.ID, "seq", seq)
+			return sink.push(ctx, seq, raw)
+		}
+
+		// seq is the sequence number of the last entry received; the
+		// responsesWorker never hands us the same entry twice.
+		var seq int64
+
 		for {
 			select {
 			case <-c.ctx.Done():
-				sub.doneCh <- nil
-				close(sub.doneCh)
+				cancel()
 				return
 			case <-ctx.Done():
-				sub.doneCh <- nil
-				close(sub.doneCh)
+				return
+			case <-sink.done():
 				return
 			case res, ok := <-resCh:
 				if !ok {
 					// Channel closed.
-					sub.doneCh <- nil
-					close(sub.doneCh)
+					sink.close(nil)
 					return
 				}
-				if res.Error != "" {
-					sub.doneCh <- errors.New(res.Error)
-					close(sub.doneCh)
+				if err := responseError(res); err != nil {
+					sink.close(err)
 					return
 				}
 
-				val, err := val.decodePayload(res.SubscribeResponse)
-				if err != nil {
-					c.log.Debugw("XREAD response: failed to decode message", "key", key, "error", err, "id", req.ID)
-					continue
-				}
-
-				c.log.Debugw("dispatching message to subscriber", "key", key, "id", req.ID)
-				if sent := sendFn(val); !sent {
-					// we could not send value because context fired.
-					// skip all further messages on this stream, and queue for
-					// removal.
-					c.log.Debugw("context was closed when dispatching message to subscriber; rm subscription", "key", key, "id", req.ID)
-					sub.doneCh <- nil
-					close(sub.doneCh)
+				seq++
+				if !dispatch(seq, res.SubscribeResponse) {
 					return
 				}
 			}
@@ -0,0 +1,492 @@
+package sync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/testground/sdk-go/runtime"
+)
+
+// ErrReplayDiverged is returned by the replaying client when an instance
+// issues an operation that has no counterpart in the recording.
+var ErrReplayDiverged = errors.New("replay diverged from recording")
+
+// Operations recorded in TrafficRecords.
+const (
+	RecordPublish         = OpPublish
+	RecordPublishBatch    = OpPublishBatch
+	RecordSubscribe       = OpSubscribe
+	RecordEntry           = "entry"
+	RecordSubscriptionEnd = "subscription_end"
+	RecordBarrier         = OpBarrier
+	RecordBarrierEnd      = "barrier_end"
+	RecordSignalEntry     = OpSignalEntry
+	RecordSignalEvent     = OpSignalEvent
+)
+
+// TrafficRecord is a request to the sync service, or a response from it, as
+// recorded by NewRecordingClient. Recordings are sequences of JSON-encoded
+// TrafficRecords, one per line.
+type TrafficRecord struct {
+	// Time is when the record was made; for requests, once the response
+	// arrived.
+	Time time.Time `json:"ts"`
+	// Sent is when the request was sent; nil for responses that follow a
+	// request, like entries and ends.
+	Sent *time.Time `json:"sent,omitempty"`
+	Op   string     `json:"op"`
+	// ID correlates subscriptions and barriers with their entries and ends.
+	ID int64 `json:"id,omitempty"`
+
+	Topic  string `json:"topic,omitempty"`
+	State  string `json:"state,omitempty"`
+	Target int    `json:"target,omitempty"`
+
+	// Payload is the payload published, the entry received, or the event
+	// signalled, as sent over the wire.
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// Payloads are the payloads of a batch.
+	Payloads []json.RawMessage `json:"payloads,omitempty"`
+
+	// Seq is the sequence number returned by publishes and signals, or the
+	// position of an entry among those delivered by its subscription.
+	Seq  int64   `json:"seq,omitempty"`
+	Seqs []int64 `json:"seqs,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// recordingClient decorates a Client, recording all its traffic.
+type recordingClient struct {
+	*sugarOperations
+
+	inner Client
+
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+	id   int64
+}
+
+var _ Client = (*recordingClient)(nil)
+
+// NewRecordingClient decorates a Client bound to the supplied RunEnv, so that
+// every request it issues, and every response it receives, is recorded with a
+// timestamp in a raw asset of the RunEnv, with the supplied name. Use
+// NewReplayClient to replay the recording.
+//
+// Closing the recording client closes the decorated Client, and the recording.
+func NewRecordingClient(client Client, runenv *runtime.RunEnv, asset string) (Client, error) {
+	file, err := runenv.CreateRawAsset(asset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording asset: %w", err)
+	}
+
+	c := &recordingClient{inner: client, file: file, enc: json.NewEncoder(file)}
+	c.sugarOperations = &sugarOperations{
+		Client:    c,
+		extractor: func(context.Context) *runtime.RunParams { return &runenv.RunParams },
+		runenv:    runenv,
+		log:       runenv.SLogger(),
+	}
+	return c, nil
+}
+
+func (c *recordingClient) nextID() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.id++
+	return c.id
+}
+
+// record writes a record. Failures are logged, but don't fail the operation
+// being recorded. Records made after Close are dropped.
+func (c *recordingClient) record(r *TrafficRecord) {
+	r.Time = time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.enc == nil {
+		return
+	}
+	if err := c.enc.Encode(r); err != nil {
+		c.logger().Warnw("failed to record sync traffic", "op", r.Op, "error", err)
+	}
+}
+
+// encodeForRecord returns a payload of a topic as sent over the wire.
+func encodeForRecord(topic *Topic, payload interface{}) json.RawMessage {
+	encoded, err := topic.encodePayload(payload)
+	if err != nil {
+		return nil
+	}
+	raw, err := json.Marshal(encoded)
+	if err != nil {
+		return nil
+	}
+	return raw
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func (c *recordingClient) Publish(ctx context.Context, topic *Topic, payload interface{}) (int64, error) {
+	sent := time.Now()
+	seq, err := c.inner.Publish(ctx, topic, payload)
+	c.record(&TrafficRecord{
+		Sent:    &sent,
+		Op:      RecordPublish,
+		Topic:   topic.name,
+		Payload: encodeForRecord(topic, payload),
+		Seq:     seq,
+		Error:   errorString(err),
+	})
+	return seq, err
+}
+
+func (c *recordingClient) PublishBatch(ctx context.Context, topic *Topic, payloads []interface{}) ([]int64, error) {
+	sent := time.Now()
+	seqs, err := c.inner.PublishBatch(ctx, topic, payloads)
+	r := &TrafficRecord{
+		Sent:  &sent,
+		Op:    RecordPublishBatch,
+		Topic: topic.name,
+		Seqs:  seqs,
+		Error: errorString(err),
+	}
+	for _, p := range payloads {
+		r.Payloads = append(r.Payloads, encodeForRecord(topic, p))
+	}
+	c.record(r)
+	return seqs, err
+}
+
+func (c *recordingClient) Subscribe(ctx context.Context, topic *Topic, ch interface{}, opts ...SubscribeOption) (*Subscription, error) {
+	var (
+		id  int64
+		seq int64
+	)
+	subscribe := func(ctx context.Context, inner interface{}) (*Subscription, error) {
+		id = c.nextID()
+		sent := time.Now()
+		sub, err := c.inner.Subscribe(ctx, topic, inner, opts...)
+		c.record(&TrafficRecord{Sent: &sent, Op: RecordSubscribe, ID: id, Topic: topic.name, Error: errorString(err)})
+		return sub, err
+	}
+	forward := func(v reflect.Value, send func(reflect.Value) bool) {
+		seq++
+		c.record(&TrafficRecord{Op: RecordEntry, ID: id, Topic: topic.name, Payload: encodeForRecord(topic, v.Interface()), Seq: seq})
+		send(v)
+	}
+	end := func(err error) {
+		c.record(&TrafficRecord{Op: RecordSubscriptionEnd, ID: id, Topic: topic.name, Error: errorString(err)})
+	}
+	return interpose(ctx, ch, subscribe, forward, end)
+}
+
+func (c *recordingClient) Barrier(ctx context.Context, state State, target int) (*Barrier, error) {
+	id := c.nextID()
+	sent := time.Now()
+	b, err := c.inner.Barrier(ctx, state, target)
+	c.record(&TrafficRecord{Sent: &sent, Op: RecordBarrier, ID: id, State: string(state), Target: target, Error: errorString(err)})
+	if err != nil {
+		return nil, err
+	}
+
+	out := &Barrier{C: make(chan error, 1)}
+	go func() {
+		err := <-b.C
+		c.record(&TrafficRecord{Op: RecordBarrierEnd, ID: id, State: string(state), Target: target, Error: errorString(err)})
+		out.C <- err
+	}()
+	return out, nil
+}
+
+func (c *recordingClient) SignalEntry(ctx context.Context, state State) (int64, error) {
+	sent := time.Now()
+	seq, err := c.inner.SignalEntry(ctx, state)
+	c.record(&TrafficRecord{Sent: &sent, Op: RecordSignalEntry, State: string(state), Seq: seq, Error: errorString(err)})
+	return seq, err
+}
+
+func (c *recordingClient) SignalEvent(ctx context.Context, event *runtime.Event) error {
+	sent := time.Now()
+	err := c.inner.SignalEvent(ctx, event)
+	payload, _ := json.Marshal(event)
+	c.record(&TrafficRecord{Sent: &sent, Op: RecordSignalEvent, Payload: payload, Error: errorString(err)})
+	return err
+}
+
+// Subscriptions returns the active subscriptions of the decorated client.
+func (c *recordingClient) Subscriptions() []*Subscription {
+	return c.inner.Subscriptions()
+}
+
+// Close closes the decorated client, and flushes and closes the recording.
+func (c *recordingClient) Close() error {
+	ierr := c.inner.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.enc == nil {
+		return ierr
+	}
+	c.enc = nil
+
+	serr := c.file.Sync()
+	cerr := c.file.Close()
+	for _, err := range []error{serr, cerr, ierr} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayClient replays the traffic of a single instance, as recorded by a
+// recordingClient.
+type replayClient struct {
+	*sugarOperations
+
+	mu sync.Mutex
+	// queues holds the records of each kind of request, in order.
+	queues map[string][]*TrafficRecord
+	// entries and ends are the responses to subscriptions and barriers.
+	entries map[int64][]*TrafficRecord
+	ends    map[int64]*TrafficRecord
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	subs   subscriptionSet
+}
+
+var _ Client = (*replayClient)(nil)
+
+// NewReplayClient returns a Client that replays a recording made by
+// NewRecordingClient, so that the behaviour of a single instance can be
+// stepped through offline, without a sync service, nor the other instances.
+//
+// Requests are matched with the recorded ones of the same kind, on the same
+// topic or state, in order; their recorded responses are returned
+// immediately, regardless of the original timing. Subscriptions deliver the
+// recorded entries. If the instance issues a request that wasn't recorded, it
+// fails with ErrReplayDiverged.
+func NewReplayClient(r io.Reader) (Client, error) {
+	c := &replayClient{
+		queues:  make(map[string][]*TrafficRecord),
+		entries: make(map[int64][]*TrafficRecord),
+		ends:    make(map[int64]*TrafficRecord),
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var rec TrafficRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("failed to parse recording: %w", err)
+		}
+		switch rec.Op {
+		case RecordEntry:
+			c.entries[rec.ID] = append(c.entries[rec.ID], &rec)
+		case RecordSubscriptionEnd, RecordBarrierEnd:
+			c.ends[rec.ID] = &rec
+		default:
+			k := replayKey(rec.Op, rec.Topic+rec.State, rec.Target)
+			c.queues[k] = append(c.queues[k], &rec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read recording: %w", err)
+	}
+
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.sugarOperations = &sugarOperations{
+		Client:    c,
+		extractor: func(context.Context) *runtime.RunParams { return &runtime.RunParams{} },
+	}
+	return c, nil
+}
+
+func replayKey(op string, name string, target int) string {
+	return fmt.Sprintf("%s:%s:%d", op, name, target)
+}
+
+// next pops the next recorded request of a kind.
+func (c *replayClient) next(op string, name string, target int) (*TrafficRecord, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := replayKey(op, name, target)
+	q := c.queues[k]
+	if len(q) == 0 {
+		return nil, fmt.Errorf("%w: unexpected %s on %s", ErrReplayDiverged, op, name)
+	}
+	c.queues[k] = q[1:]
+	return q[0], nil
+}
+
+// recordedError returns the error recorded in a record, if any.
+func recordedError(r *TrafficRecord) error {
+	if r.Error == "" {
+		return nil
+	}
+	return errors.New(r.Error)
+}
+
+func (c *replayClient) Publish(ctx context.Context, topic *Topic, payload interface{}) (int64, error) {
+	if !topic.validatePayload(payload) {
+		return -1, fmt.Errorf("invalid payload type; expected: [*]%s, was: %T", topic.typ, payload)
+	}
+	rec, err := c.next(RecordPublish, topic.name, 0)
+	if err != nil {
+		return -1, err
+	}
+	if err := recordedError(rec); err != nil {
+		return -1, err
+	}
+	return rec.Seq, nil
+}
+
+func (c *replayClient) PublishBatch(ctx context.Context, topic *Topic, payloads []interface{}) ([]int64, error) {
+	rec, err := c.next(RecordPublishBatch, topic.name, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordedError(rec); err != nil {
+		return nil, err
+	}
+	return rec.Seqs, nil
+}
+
+func (c *replayClient) Subscribe(ctx context.Context, topic *Topic, ch interface{}, opts ...SubscribeOption) (*Subscription, error) {
+	// the recording reflects the options already, except for the closure
+	// of the channel.
+	sink, err := newSink(topic.name, topic.typeValidator, ch)
+	if err != nil {
+		return nil, err
+	}
+	var o subscribeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	sink.opts.closeOnDone = o.closeOnDone
+
+	rec, err := c.next(RecordSubscribe, topic.name, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordedError(rec); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	entries, end := c.entries[rec.ID], c.ends[rec.ID]
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	sub := sink.subscription(cancel)
+	c.subs.add(sub)
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		for _, e := range entries {
+			if ok, err := sink.deliver(ctx, e.Seq, string(e.Payload)); !ok {
+				sub.finish(err, ctx.Err())
+				return
+			}
+		}
+
+		if end != nil && end.Error != "" {
+			sub.finish(recordedError(end), nil)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			sub.finish(nil, ctx.Err())
+		case <-c.ctx.Done():
+			sub.finish(nil, ErrClientClosed)
+		}
+	}()
+
+	return sub, nil
+}
+
+func (c *replayClient) Barrier(ctx context.Context, state State, target int) (*Barrier, error) {
+	rec, err := c.next(RecordBarrier, string(state), target)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordedError(rec); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	end := c.ends[rec.ID]
+	c.mu.Unlock()
+
+	b := &Barrier{C: make(chan error, 1)}
+	if end != nil {
+		b.C <- recordedError(end)
+		return b, nil
+	}
+
+	// the barrier never fired while recording.
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		select {
+		case <-ctx.Done():
+			b.C <- ctx.Err()
+		case <-c.ctx.Done():
+			b.C <- c.ctx.Err()
+		}
+	}()
+	return b, nil
+}
+
+func (c *replayClient) SignalEntry(ctx context.Context, state State) (int64, error) {
+	rec, err := c.next(RecordSignalEntry, string(state), 0)
+	if err != nil {
+		return -1, err
+	}
+	if err := recordedError(rec); err != nil {
+		return -1, err
+	}
+	return rec.Seq, nil
+}
+
+func (c *replayClient) SignalEvent(ctx context.Context, event *runtime.Event) error {
+	rec, err := c.next(RecordSignalEvent, "", 0)
+	if err != nil {
+		return err
+	}
+	return recordedError(rec)
+}
+
+// Subscriptions returns the replayed subscriptions that are active.
+func (c *replayClient) Subscriptions() []*Subscription {
+	return c.subs.list()
+}
+
+// Close terminates the replayed subscriptions and barriers.
+func (c *replayClient) Close() error {
+	c.cancel()
+	c.wg.Wait()
+	return nil
+}
@@ -0,0 +1,96 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/testground/sdk-go/runtime"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	runenv, cleanup := runtime.RandomTestRunEnv(t)
+	t.Cleanup(cleanup)
+
+	type peer struct{ Addr string }
+	var (
+		hub   = NewInmemHub()
+		other = hub.NewBoundClient(&runenv.RunParams)
+		topic = NewTopic("peers", &peer{})
+		state = State("ready")
+	)
+	defer other.Close()
+
+	// play the instance under scrutiny, while another one interacts with it.
+	play := func(client Client) (seq int64, peers []string, err error) {
+		if seq, err = client.Publish(ctx, topic, &peer{"a"}); err != nil {
+			return
+		}
+		ch := make(chan *peer, 2)
+		if _, err = client.Subscribe(ctx, topic, ch); err != nil {
+			return
+		}
+		peers = append(peers, (<-ch).Addr, (<-ch).Addr)
+		_, err = client.SignalAndWait(ctx, state, 2)
+		return
+	}
+
+	inner := hub.NewBoundClient(&runenv.RunParams)
+	recording, err := NewRecordingClient(inner, runenv, "sync.jsonl")
+	require.NoError(t, err)
+
+	other.MustPublish(ctx, topic, &peer{"b"})
+	other.MustSignalEntry(ctx, state)
+
+	seq, peers, err := play(recording)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, seq)
+	require.Equal(t, []string{"b", "a"}, peers)
+	require.NoError(t, recording.Close())
+
+	// the recording is closed along with the client.
+	_, err = recording.(*recordingClient).file.Write([]byte("\n"))
+	require.True(t, errors.Is(err, os.ErrClosed), err)
+
+	// replay without the other instance, nor the hub.
+	file, err := os.Open(filepath.Join(runenv.TestOutputsPath, "sync.jsonl"))
+	require.NoError(t, err)
+	defer file.Close()
+
+	// requests record when they were sent, responses only when they arrived.
+	dec := json.NewDecoder(file)
+	for dec.More() {
+		var rec TrafficRecord
+		require.NoError(t, dec.Decode(&rec))
+		if rec.Op == RecordEntry || rec.Op == RecordSubscriptionEnd || rec.Op == RecordBarrierEnd {
+			require.Nil(t, rec.Sent, rec.Op)
+			continue
+		}
+		require.NotNil(t, rec.Sent, rec.Op)
+		require.False(t, rec.Sent.After(rec.Time), rec.Op)
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	replay, err := NewReplayClient(file)
+	require.NoError(t, err)
+	defer replay.Close()
+
+	rseq, rpeers, err := play(replay)
+	require.NoError(t, err)
+	require.Equal(t, seq, rseq)
+	require.Equal(t, peers, rpeers)
+
+	// anything beyond the recording diverges.
+	_, err = replay.SignalEntry(ctx, state)
+	require.True(t, errors.Is(err, ErrReplayDiverged), err)
+}
@@ -0,0 +1,282 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/testground/sdk-go/runtime"
+	"go.uber.org/zap"
+)
+
+// shared holds the connections to the sync service shared by the clients
+// obtained through NewSharedClient, by address.
+var shared = struct {
+	sync.Mutex
+	conns map[string]*sharedConn
+}{conns: make(map[string]*sharedConn)}
+
+// sharedConn is a generic DefaultClient shared by several sharedClients.
+type sharedConn struct {
+	addr   string
+	client *DefaultClient
+	refs   int
+}
+
+// sharedClient is a view over a shared generic DefaultClient, bound to a
+// RunEnv.
+type sharedClient struct {
+	*sugarOperations
+
+	conn    *sharedConn
+	rp      *runtime.RunParams
+	binding *binding
+	subs    subscriptionSet
+	closed  sync.Once
+
+	// ctx is cancelled when this client is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+var _ Client = (*sharedClient)(nil)
+
+// NewSharedClient returns a sync Client bound to the provided RunEnv, like
+// NewBoundClient, but backed by a connection to the sync service that is
+// shared with all other shared clients in this process. This allows libraries
+// used by a test plan to obtain a sync client without opening an additional
+// connection.
+//
+// The connection is reference counted: it is opened by the first call, and
+// closed when the last client obtained through this function is closed. Each
+// client must be closed exactly once; further calls to Close are no-ops.
+// Closing a client cancels its own operations, like a DefaultClient does, but
+// not those of the other clients.
+//
+// The context governs the connection attempt only; the connection outlives the
+// contexts of the callers. The requests of each client are logged to the
+// logger of its RunEnv, and recorded in its diagnostics metrics, like those of
+// a bound client.
+//
+// The default run.InitSyncClientFactory returns shared clients.
+func NewSharedClient(ctx context.Context, runenv *runtime.RunEnv) (Client, error) {
+	addr, err := socketAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := acquireConn(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	rp := &runenv.RunParams
+	c := &sharedClient{conn: conn, rp: rp}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.binding = newBinding(runenv, c.ctx.Done())
+	c.sugarOperations = &sugarOperations{
+		Client:    c,
+		extractor: func(context.Context) *runtime.RunParams { return rp },
+		runenv:    runenv,
+		log:       runenv.SLogger(),
+	}
+	return c, nil
+}
+
+// acquireConn returns the shared connection to the sync service at the
+// supplied address, taking a reference to it. If there's none, it dials one,
+// without holding the lock, so that other callers aren't held up.
+func acquireConn(ctx context.Context, addr string) (*sharedConn, error) {
+	shared.Lock()
+	if conn, ok := shared.conns[addr]; ok {
+		conn.refs++
+		shared.Unlock()
+		return conn, nil
+	}
+	shared.Unlock()
+
+	// the connection outlives the contexts of the callers, and logs events of
+	// its own, like reconnections, to the global logger.
+	dial := WebSocketDialer(addr, nil)
+	first := true
+	client, err := newClientWithDialer(context.Background(), zap.S(), GetRunParams, nil, func(cctx context.Context) (Transport, error) {
+		if first {
+			first = false
+			return dial(ctx)
+		}
+		return dial(cctx)
+	}, DefaultReadTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	shared.Lock()
+	defer shared.Unlock()
+
+	// another caller may have connected meanwhile.
+	if conn, ok := shared.conns[addr]; ok {
+		conn.refs++
+		go client.Close()
+		return conn, nil
+	}
+	conn := &sharedConn{addr: addr, client: client, refs: 1}
+	shared.conns[addr] = conn
+	return conn, nil
+}
+
+// MustSharedClient creates a new shared client by calling NewSharedClient, and
+// panicking if it errors.
+func MustSharedClient(ctx context.Context, runenv *runtime.RunEnv) Client {
+	c, err := NewSharedClient(ctx, runenv)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// scope returns a context that injects the RunParams and the binding of this
+// client, and that fires when either the supplied context fires, or this
+// client is closed. It fails with ErrClientClosed if the client is closed.
+func (c *sharedClient) scope(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	if c.ctx.Err() != nil {
+		return nil, nil, ErrClientClosed
+	}
+
+	ctx, cancel := context.WithCancel(withBinding(WithRunParams(ctx, c.rp), c.binding))
+	go func() {
+		select {
+		case <-c.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel, nil
+}
+
+// closedErr returns ErrClientClosed if this client was closed, or err.
+func (c *sharedClient) closedErr(err error) error {
+	if err != nil && c.ctx.Err() != nil {
+		return ErrClientClosed
+	}
+	return err
+}
+
+func (c *sharedClient) Publish(ctx context.Context, topic *Topic, payload interface{}) (int64, error) {
+	ctx, cancel, err := c.scope(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer cancel()
+
+	seq, err := c.conn.client.Publish(ctx, topic, payload)
+	return seq, c.closedErr(err)
+}
+
+func (c *sharedClient) PublishBatch(ctx context.Context, topic *Topic, payloads []interface{}) ([]int64, error) {
+	ctx, cancel, err := c.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	seqs, err := c.conn.client.PublishBatch(ctx, topic, payloads)
+	return seqs, c.closedErr(err)
+}
+
+func (c *sharedClient) Subscribe(ctx context.Context, topic *Topic, ch interface{}, opts ...SubscribeOption) (*Subscription, error) {
+	ctx, cancel, err := c.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// track the subscription as one of this client's, until it ends.
+	subscribe := func(ctx context.Context, inner interface{}) (*Subscription, error) {
+		return c.conn.client.Subscribe(ctx, topic, inner, opts...)
+	}
+	forward := func(v reflect.Value, send func(reflect.Value) bool) {
+		send(v)
+	}
+	end := func(error) {
+		cancel()
+	}
+	sub, err := interpose(ctx, ch, subscribe, forward, end)
+	if err != nil {
+		cancel()
+		return nil, c.closedErr(err)
+	}
+	c.subs.add(sub)
+	return sub, nil
+}
+
+func (c *sharedClient) Barrier(ctx context.Context, state State, target int) (*Barrier, error) {
+	ctx, cancel, err := c.scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := c.conn.client.Barrier(ctx, state, target)
+	if err != nil {
+		cancel()
+		return nil, c.closedErr(err)
+	}
+
+	out := &Barrier{C: make(chan error, 1)}
+	go func() {
+		defer cancel()
+		out.C <- c.closedErr(<-b.C)
+	}()
+	return out, nil
+}
+
+func (c *sharedClient) SignalEntry(ctx context.Context, state State) (int64, error) {
+	ctx, cancel, err := c.scope(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer cancel()
+
+	seq, err := c.conn.client.SignalEntry(ctx, state)
+	return seq, c.closedErr(err)
+}
+
+func (c *sharedClient) SignalEvent(ctx context.Context, event *runtime.Event) error {
+	ctx, cancel, err := c.scope(ctx)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	return c.closedErr(c.conn.client.SignalEvent(ctx, event))
+}
+
+// Subscriptions returns the active subscriptions of this client, oldest first,
+// excluding those of other shared clients.
+func (c *sharedClient) Subscriptions() []*Subscription {
+	return c.subs.list()
+}
+
+// Close closes this client, cancelling its ongoing operations, and releases
+// its reference to the shared connection. The connection is closed when no
+// client uses it anymore.
+func (c *sharedClient) Close() (err error) {
+	c.closed.Do(func() {
+		c.subs.warnActive(c.logger())
+		c.cancel()
+		c.binding.metrics.release()
+
+		shared.Lock()
+		defer shared.Unlock()
+
+		if c.conn.refs--; c.conn.refs > 0 {
+			return
+		}
+		if shared.conns[c.conn.addr] == c.conn {
+			delete(shared.conns, c.conn.addr)
+		}
+		if err = c.conn.client.Close(); err != nil {
+			err = fmt.Errorf("failed to close shared connection to sync service: %w", err)
+		}
+	})
+	return err
+}
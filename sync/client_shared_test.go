@@ -0,0 +1,101 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/testground/sdk-go/runtime"
+)
+
+func TestSharedClient(t *testing.T) {
+	startSyncService(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	runenv, cleanup := runtime.RandomTestRunEnv(t)
+	t.Cleanup(cleanup)
+
+	a := MustSharedClient(ctx, runenv)
+	b := MustSharedClient(ctx, runenv)
+	require.Same(t, a.(*sharedClient).conn, b.(*sharedClient).conn)
+	require.Equal(t, 2, a.(*sharedClient).conn.refs)
+
+	// operations are scoped to the RunEnv without passing RunParams along.
+	topic := NewTopic("shared", "")
+	a.MustPublish(ctx, topic, "hello")
+	require.NoError(t, a.Close())
+	require.NoError(t, a.Close(), "closing twice must be a no-op")
+
+	ch := make(chan string, 1)
+	b.MustSubscribe(ctx, topic, ch)
+	require.Equal(t, "hello", <-ch)
+
+	require.NoError(t, b.Close())
+	shared.Lock()
+	require.Empty(t, shared.conns)
+	shared.Unlock()
+}
+
+func TestSharedClientDialContext(t *testing.T) {
+	startSyncService(t)
+
+	runenv, cleanup := runtime.RandomTestRunEnv(t)
+	t.Cleanup(cleanup)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := NewSharedClient(ctx, runenv)
+	require.Error(t, err)
+	shared.Lock()
+	require.Empty(t, shared.conns)
+	shared.Unlock()
+}
+
+func TestSharedClientClose(t *testing.T) {
+	startSyncService(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	runenv, cleanup := runtime.RandomTestRunEnv(t)
+	t.Cleanup(cleanup)
+
+	a := MustSharedClient(ctx, runenv)
+	b := MustSharedClient(ctx, runenv)
+	t.Cleanup(func() { _ = b.Close() })
+
+	topic := NewTopic("shared-close", "")
+	sa := a.MustSubscribe(ctx, topic, make(chan string))
+	sb := b.MustSubscribe(ctx, topic, make(chan string))
+	require.Equal(t, []*Subscription{sa}, a.Subscriptions())
+	require.Equal(t, []*Subscription{sb}, b.Subscriptions())
+
+	ba := a.MustBarrier(ctx, "never", 2)
+
+	// closing a terminates its operations, but not those of b.
+	require.NoError(t, a.Close())
+	require.Nil(t, <-sa.Done())
+	require.True(t, errors.Is(sa.Err(), ErrClientClosed))
+	require.True(t, errors.Is(<-ba.C, ErrClientClosed))
+	require.Empty(t, a.Subscriptions())
+	require.Nil(t, sb.Err())
+
+	_, err := a.Publish(ctx, topic, "hello")
+	require.True(t, errors.Is(err, ErrClientClosed))
+	_, err = a.Subscribe(ctx, topic, make(chan string))
+	require.True(t, errors.Is(err, ErrClientClosed))
+	_, err = a.Barrier(ctx, "never", 2)
+	require.True(t, errors.Is(err, ErrClientClosed))
+	_, err = a.SignalEntry(ctx, "never")
+	require.True(t, errors.Is(err, ErrClientClosed))
+
+	b.MustPublish(ctx, topic, "hello")
+	sb.Cancel()
+	<-sb.Done()
+	require.Empty(t, b.Subscriptions())
+}
@@ -27,7 +27,7 @@ func (c *DefaultClient) Barrier(ctx context.Context, state State, target int) (*
 	// a barrier with target zero is satisfied immediately; log a warning as
 	// this is probably programmer error.
 	if target == 0 {
-		c.log.Warnw("requested a barrier with target zero; satisfying immediately", "state", state)
+		c.logFor(ctx).Warnw("requested a barrier with target zero; satisfying immediately", "state", state)
 		b := &Barrier{C: make(chan error, 1)}
 		b.C <- nil
 		close(b.C)
@@ -42,6 +42,7 @@ func (c *DefaultClient) Barrier(ctx context.Context, state State, target int) (*
 	key := state.Key(rp)
 
 	ctx, cancel := context.WithCancel(ctx)
+	done := c.metricsFor(ctx).observe(OpBarrier)
 
 	ch, err := c.makeRequest(ctx, &sync.Request{
 		BarrierRequest: &sync.BarrierRequest{
@@ -50,6 +51,7 @@ func (c *DefaultClient) Barrier(ctx context.Context, state State, target int) (*
 		},
 	})
 	if err != nil {
+		done()
 		cancel()
 		return nil, err
 	}
@@ -60,12 +62,14 @@ func (c *DefaultClient) Barrier(ctx context.Context, state State, target int) (*
 
 	go func() {
 		res, ok := <-ch
+		done()
 		if !ok {
 			b.C <- errors.New("channel closed before getting response")
-		} else if res.Error == "" {
-			b.C <- nil
+		} else if err := responseError(res); err != nil {
+			b.C <- err
 		} else {
-			b.C <- errors.New(res.Error)
+			c.logFor(ctx).Debugw("barrier released", "key", key, "id", res.ID)
+			b.C <- nil
 		}
 
 		cancel()
@@ -84,7 +88,8 @@ func (c *DefaultClient) SignalEntry(ctx context.Context, state State) (int64, er
 
 	key := state.Key(rp)
 
-	c.log.Debugw("signalling entry to state", "key", key)
+	c.logFor(ctx).Debugw("signalling entry to state", "key", key)
+	defer c.metricsFor(ctx).observe(OpSignalEntry)()
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -103,11 +108,11 @@ func (c *DefaultClient) SignalEntry(ctx context.Context, state State) (int64, er
 	if !ok {
 		return -1, errors.New("channel closed before getting response")
 	}
-	if res.Error != "" {
-		return -1, errors.New(res.Error)
+	if err := responseError(res); err != nil {
+		return -1, err
 	}
 
-	c.log.Debugw("new value of state", "key", key, "value", res.SignalEntryResponse.Seq)
+	c.logFor(ctx).Debugw("new value of state", "key", key, "id", res.ID, "value", res.SignalEntryResponse.Seq)
 	return int64(res.SignalEntryResponse.Seq), nil
 }
 
@@ -118,8 +123,7 @@ func (c *DefaultClient) SignalEvent(ctx context.Context, event *runtime.Event) (
 		return ErrNoRunParameters
 	}
 
-	key := fmt.Sprintf("run:%s:plan:%s:case:%s:run_events", rp.TestRun, rp.TestPlan, rp.TestCase)
-	_, err = c.publish(ctx, key, event)
+	_, err = c.publish(ctx, eventsKey(rp), event)
 	return err
 }
 
@@ -128,12 +132,25 @@ func (c *DefaultClient) SignalEvent(ctx context.Context, event *runtime.Event) (
 // FailureEvent and CrashEvent.
 func (c *DefaultClient) SubscribeEvents(ctx context.Context, rp *runtime.RunParams) (chan *runtime.Event, error) {
 	ch := make(chan *runtime.Event)
-	key := fmt.Sprintf("run:%s:plan:%s:case:%s:run_events", rp.TestRun, rp.TestPlan, rp.TestCase)
+	key := eventsKey(rp)
+	sink, err := newSink(key, eventsValidator, ch)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err := c.subscribe(ctx, key, false, &typeValidator{reflect.TypeOf(&runtime.Event{})}, ch)
+	_, err = c.subscribe(ctx, key, sink)
 	if err != nil {
 		return nil, err
 	}
 
 	return ch, nil
 }
+
+// eventsValidator validates and decodes the entries of the events topic.
+var eventsValidator = &typeValidator{typ: reflect.TypeOf(&runtime.Event{})}
+
+// eventsKey returns the key of the topic where the events of a run are
+// published.
+func eventsKey(rp *runtime.RunParams) string {
+	return fmt.Sprintf("run:%s:plan:%s:case:%s:run_events", rp.TestRun, rp.TestPlan, rp.TestCase)
+}
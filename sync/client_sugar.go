@@ -2,11 +2,45 @@ package sync
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
+
+	"github.com/testground/sdk-go/runtime"
+	"go.uber.org/zap"
 )
 
+// StateProgressGauge is the name of the diagnostics gauge, in RunEnv.D(),
+// where WatchState records the value of the state counters being watched by
+// bound clients. It is tagged with the name of the state.
+const StateProgressGauge = "sync.state.progress"
+
+// WatchStateWindow is the number of barriers WatchState keeps in flight.
+var WatchStateWindow = 16
+
 type sugarOperations struct {
 	Client
+
+	extractor func(ctx context.Context) *runtime.RunParams
+	runenv    *runtime.RunEnv    // nil unless bound to a RunEnv
+	log       *zap.SugaredLogger // nil means the global logger
+}
+
+// logger returns the logger of the client.
+func (c *sugarOperations) logger() *zap.SugaredLogger {
+	if c.log == nil {
+		return zap.S()
+	}
+	return c.log
+}
+
+// loggerOf returns the logger of the supplied client, or the global logger if
+// it has none.
+func loggerOf(client Client) *zap.SugaredLogger {
+	if s, ok := client.(interface{ sugar() *sugarOperations }); ok {
+		return s.sugar().logger()
+	}
+	return zap.S()
 }
 
 // PublishAndWait composes Publish and a Barrier. It first publishes the
@@ -42,6 +76,84 @@ func (c *sugarOperations) MustPublishAndWait(ctx context.Context, topic *Topic,
 	return seq
 }
 
+// PublishBatch publishes a batch of items on the supplied topic, one after
+// the other, returning their sequence numbers. All payloads are validated
+// before any is published; it then stops at the first error.
+//
+// Clients that can pipeline requests, like the DefaultClient, override it.
+func (c *sugarOperations) PublishBatch(ctx context.Context, topic *Topic, payloads []interface{}) (seqs []int64, err error) {
+	for _, payload := range payloads {
+		if !topic.validatePayload(payload) {
+			return nil, fmt.Errorf("invalid payload type; expected: [*]%s, was: %T", topic.typ, payload)
+		}
+	}
+
+	seqs = make([]int64, 0, len(payloads))
+	for _, payload := range payloads {
+		seq, err := c.Publish(ctx, topic, payload)
+		if err != nil {
+			return nil, err
+		}
+		seqs = append(seqs, seq)
+	}
+	return seqs, nil
+}
+
+// MustPublishBatch calls PublishBatch, panicking if it errors.
+//
+// Suitable for shorthanding in test plans.
+func (c *sugarOperations) MustPublishBatch(ctx context.Context, topic *Topic, payloads []interface{}) (seqs []int64) {
+	// dispatch through the Client, which might override PublishBatch.
+	seqs, err := c.Client.PublishBatch(ctx, topic, payloads)
+	if err != nil {
+		panic(err)
+	}
+	return seqs
+}
+
+// BarrierAll sets barriers on several states at once, issuing them all
+// without waiting for each other, and returns a Barrier that fires when all of
+// them have reached their targets, or with the first error.
+func (c *sugarOperations) BarrierAll(ctx context.Context, targets map[State]int) (*Barrier, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	done := make(chan error, len(targets))
+	for state, target := range targets {
+		b, err := c.Barrier(ctx, state, target)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("failed while setting barrier for state %s, with target %d: %w", state, target, err)
+		}
+		go func() {
+			done <- <-b.C
+		}()
+	}
+
+	all := &Barrier{C: make(chan error, 1)}
+	go func() {
+		defer cancel()
+		for range targets {
+			if err := <-done; err != nil {
+				all.C <- err
+				return
+			}
+		}
+		all.C <- nil
+	}()
+	return all, nil
+}
+
+// MustBarrierAll calls BarrierAll, panicking if it errors.
+//
+// Suitable for shorthanding in test plans.
+func (c *sugarOperations) MustBarrierAll(ctx context.Context, targets map[State]int) *Barrier {
+	b, err := c.BarrierAll(ctx, targets)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
 // PublishSubscribe publishes the payload on the supplied Topic, then subscribes
 // to it, sending paylods to the supplied channel.
 //
@@ -49,12 +161,12 @@ func (c *sugarOperations) MustPublishAndWait(ctx context.Context, topic *Topic,
 // error and a negative sequence. If Publish succeeds, but Subscribe fails,
 // the seq number will be greater than zero, but the returned Subscription will
 // be nil, and the error, non-nil.
-func (c *sugarOperations) PublishSubscribe(ctx context.Context, topic *Topic, payload interface{}, ch interface{}) (seq int64, sub *Subscription, err error) {
+func (c *sugarOperations) PublishSubscribe(ctx context.Context, topic *Topic, payload interface{}, ch interface{}, opts ...SubscribeOption) (seq int64, sub *Subscription, err error) {
 	seq, err = c.Publish(ctx, topic, payload)
 	if err != nil {
 		return -1, nil, err
 	}
-	sub, err = c.Subscribe(ctx, topic, ch)
+	sub, err = c.Subscribe(ctx, topic, ch, opts...)
 	if err != nil {
 		return seq, nil, err
 	}
@@ -64,8 +176,8 @@ func (c *sugarOperations) PublishSubscribe(ctx context.Context, topic *Topic, pa
 // MustPublishSubscribe calls PublishSubscribe, panicking if it errors.
 //
 // Suitable for shorthanding in test plans.
-func (c *sugarOperations) MustPublishSubscribe(ctx context.Context, topic *Topic, payload interface{}, ch interface{}) (seq int64, sub *Subscription) {
-	seq, sub, err := c.PublishSubscribe(ctx, topic, payload, ch)
+func (c *sugarOperations) MustPublishSubscribe(ctx context.Context, topic *Topic, payload interface{}, ch interface{}, opts ...SubscribeOption) (seq int64, sub *Subscription) {
+	seq, sub, err := c.PublishSubscribe(ctx, topic, payload, ch, opts...)
 	if err != nil {
 		panic(err)
 	}
@@ -106,6 +218,225 @@ func (c *sugarOperations) MustSignalAndWait(ctx context.Context, state State, ta
 	return seq
 }
 
+// SignalAndWaitTimeout is like SignalAndWait, but gives up waiting after the
+// supplied timeout, returning a *BarrierTimeoutError that reports which
+// instances arrived, and which ones are missing.
+//
+// To that end, instances register their arrival, along with their group ID and
+// their position among the arrivals of their group, on a topic associated with
+// the state; only the instances that enter the state through this method can
+// be accounted for. The topic is only read once the wait times out. The
+// report is also signalled as a message event.
+func (c *sugarOperations) SignalAndWaitTimeout(ctx context.Context, state State, target int, timeout time.Duration) (seq int64, err error) {
+	rp := c.extractor(ctx)
+	if rp == nil {
+		return -1, ErrNoRunParameters
+	}
+
+	wctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	seq, err = c.SignalEntry(ctx, state)
+	if err != nil {
+		return -1, fmt.Errorf("failed while signalling entry to state %s: %w", state, err)
+	}
+	gseq, err := c.SignalEntry(ctx, arrivalsState(state).InGroup(rp.TestGroupID))
+	if err != nil {
+		return -1, fmt.Errorf("failed while signalling entry to state %s: %w", state, err)
+	}
+
+	topic := arrivalsTopic(state)
+	arrival := &Arrival{GroupID: rp.TestGroupID, GroupInstances: rp.TestGroupInstanceCount, GroupSeq: gseq, Seq: seq}
+	if _, err = c.Publish(ctx, topic, &arrivalEntry{Arrival: arrival}); err != nil {
+		return -1, fmt.Errorf("failed while registering arrival to state %s: %w", state, err)
+	}
+
+	b, err := c.Barrier(wctx, state, target)
+	if err != nil {
+		return -1, fmt.Errorf("failed while setting barrier for state %s, with target %d: %w", state, target, err)
+	}
+
+	if err = <-b.C; err == nil || ctx.Err() != nil || !errors.Is(wctx.Err(), context.DeadlineExceeded) {
+		return seq, err
+	}
+
+	// the barrier timed out, and not because of the parent context.
+	rctx, rcancel := context.WithTimeout(WithRunParams(context.Background(), rp), ArrivalsReadTimeout)
+	defer rcancel()
+
+	arrivals, err := c.readArrivals(rctx, topic)
+	if err != nil {
+		return seq, fmt.Errorf("barrier on state %s timed out; failed to read arrivals: %w", state, err)
+	}
+	report := newBarrierTimeoutError(state, target, rp, arrivals)
+
+	_ = c.SignalEvent(rctx, &runtime.Event{MessageEvent: &runtime.MessageEvent{Message: report.Error()}})
+
+	return seq, report
+}
+
+// ArrivalsReadTimeout bounds the reading of the arrivals to a state, once
+// SignalAndWaitTimeout times out.
+var ArrivalsReadTimeout = 10 * time.Second
+
+// readArrivals reads the arrivals registered on a topic so far. It appends a
+// marker to the topic, and reads up to it.
+func (c *sugarOperations) readArrivals(ctx context.Context, topic *Topic) ([]Arrival, error) {
+	marker, err := publishEntry(ctx, c, topic, &arrivalEntry{})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch := make(chan *arrivalEntry, 64)
+	sub, err := c.Subscribe(ctx, topic, ch, CloseOnDone())
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		arrivals []Arrival
+		last     *arrivalEntry
+	)
+	for i := int64(1); i <= marker; {
+		e, ok := <-ch
+		if !ok {
+			if err := sub.Err(); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("arrivals subscription ended early")
+		}
+		// skip duplicate deliveries; see logView.follow.
+		if e == last {
+			continue
+		}
+		last = e
+		i++
+		if e.Arrival != nil {
+			arrivals = append(arrivals, *e.Arrival)
+		}
+	}
+	return arrivals, nil
+}
+
+// MustSignalAndWaitTimeout calls SignalAndWaitTimeout, panicking if it errors.
+//
+// Suitable for shorthanding in test plans.
+func (c *sugarOperations) MustSignalAndWaitTimeout(ctx context.Context, state State, target int, timeout time.Duration) (seq int64) {
+	seq, err := c.SignalAndWaitTimeout(ctx, state, target, timeout)
+	if err != nil {
+		panic(err)
+	}
+	return seq
+}
+
+// arrivalEntry is an entry of an arrivals topic: an arrival, or a marker
+// appended by readArrivals, without one.
+type arrivalEntry struct {
+	Arrival *Arrival `json:"arrival,omitempty"`
+}
+
+// arrivalsTopic returns the topic where the arrivals to a state are
+// registered, in the same scope as the state.
+func arrivalsTopic(state State) *Topic {
+	name, global := globalName(string(state))
+	topic := NewTopic("arrivals:"+name, &arrivalEntry{})
+	if global {
+		return topic.Global()
+	}
+	return topic
+}
+
+// arrivalsState returns the state whose counter, scoped to a group, tells the
+// position of instances among the arrivals of their group to a state.
+func arrivalsState(state State) State {
+	name, global := globalName(string(state))
+	if global {
+		return State("arrivals:" + name).Global()
+	}
+	return State("arrivals:" + name)
+}
+
+// WatchState streams the value of the counter of a state, from one onwards,
+// emitting every increment in order. The channel is closed when the context
+// fires, or if a barrier fails, in which case the error is logged.
+//
+// WatchState is built on barriers: it keeps WatchStateWindow barriers in
+// flight, on the next values of the counter. Bound clients also record the
+// latest value under the StateProgressGauge in RunEnv.D().
+func (c *sugarOperations) WatchState(ctx context.Context, state State) (<-chan int64, error) {
+	if c.extractor(ctx) == nil {
+		return nil, ErrNoRunParameters
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var gauge runtime.Gauge
+	if c.runenv != nil {
+		gauge = c.runenv.D().Gauge(fmt.Sprintf("%s,state=%s", StateProgressGauge, state))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	out := make(chan int64)
+
+	// window holds the in-flight barriers, in increasing order of target.
+	size := WatchStateWindow
+	if size < 1 {
+		size = 1
+	}
+	window := make([]*Barrier, 0, size)
+	next := 1
+	fill := func() error {
+		for ; len(window) < size; next++ {
+			b, err := c.Barrier(ctx, state, next)
+			if err != nil {
+				return err
+			}
+			window = append(window, b)
+		}
+		return nil
+	}
+
+	if err := fill(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go func() {
+		defer cancel()
+		defer close(out)
+
+		for value := int64(1); ; value++ {
+			if err := <-window[0].C; err != nil {
+				if ctx.Err() == nil {
+					c.logger().Warnw("failed to watch state", "state", state, "error", err)
+				}
+				return
+			}
+			if gauge != nil {
+				gauge.Update(float64(value))
+			}
+
+			select {
+			case out <- value:
+			case <-ctx.Done():
+				return
+			}
+
+			window = window[1:]
+			if err := fill(); err != nil {
+				c.logger().Warnw("failed to watch state", "state", state, "error", err)
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
 // MustSignalEntry calls SignalEntry, panicking if it errors.
 //
 // Suitable for shorthanding in test plans.
@@ -142,8 +473,8 @@ func (c *sugarOperations) MustPublish(ctx context.Context, topic *Topic, payload
 // MustSubscribe calls Subscribe, panicking if it errors.
 //
 // Suitable for shorthanding in test plans.
-func (c *sugarOperations) MustSubscribe(ctx context.Context, topic *Topic, ch interface{}) (sub *Subscription) {
-	sub, err := c.Subscribe(ctx, topic, ch)
+func (c *sugarOperations) MustSubscribe(ctx context.Context, topic *Topic, ch interface{}, opts ...SubscribeOption) (sub *Subscription) {
+	sub, err := c.Subscribe(ctx, topic, ch, opts...)
 	if err != nil {
 		panic(err)
 	}
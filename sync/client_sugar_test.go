@@ -0,0 +1,170 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/testground/sdk-go/runtime"
+)
+
+func TestSignalAndWaitTimeoutReportsStragglers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var (
+		hub   = NewInmemHub()
+		rp    = runtime.RunParams{TestRun: "run", TestInstanceCount: 6}
+		state = State("stragglers")
+	)
+
+	// group "a" has three instances, but only one of them shows up; no
+	// instance of group "c" shows up.
+	ra, rb := rp, rp
+	ra.TestGroupID, ra.TestGroupInstanceCount = "a", 3
+	rb.TestGroupID, rb.TestGroupInstanceCount = "b", 1
+	a, b := hub.NewBoundClient(&ra), hub.NewBoundClient(&rb)
+	defer a.Close()
+	defer b.Close()
+
+	events, err := a.SubscribeEvents(ctx, &ra)
+	require.NoError(t, err)
+
+	errs := make(chan error, 2)
+	for _, c := range []*InmemClient{a, b} {
+		go func(c *InmemClient) {
+			_, err := c.SignalAndWaitTimeout(ctx, state, 6, 200*time.Millisecond)
+			errs <- err
+		}(c)
+	}
+
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+
+		var report *BarrierTimeoutError
+		require.True(t, errors.As(err, &report), err)
+		require.Equal(t, 2, report.Current)
+		require.Equal(t, map[string][]int64{"a": {2, 3}}, report.Missing)
+		require.Equal(t, 2, report.Unaccounted)
+		require.Equal(t, []Arrival{
+			{GroupID: "a", GroupInstances: 3, GroupSeq: 1, Seq: report.Arrivals[0].Seq},
+			{GroupID: "b", GroupInstances: 1, GroupSeq: 1, Seq: report.Arrivals[1].Seq},
+		}, report.Arrivals)
+		require.EqualError(t, err, "barrier on state stragglers timed out at 2/6; missing: a#{2-3}; 2 unaccounted")
+	}
+
+	evt := <-events
+	require.NotNil(t, evt.MessageEvent)
+	require.Contains(t, evt.MessageEvent.Message, "missing: a#{2-3}")
+
+	// a barrier that is met returns no error.
+	_, err = b.SignalAndWaitTimeout(ctx, state, 3, time.Second)
+	require.NoError(t, err)
+}
+
+func TestSignalAndWaitTimeoutMet(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rp := &runtime.RunParams{TestRun: "run", TestGroupID: "a", TestGroupInstanceCount: 1}
+	client := NewInmemHub().NewBoundClient(rp)
+	defer client.Close()
+
+	_, err := client.SignalAndWaitTimeout(ctx, "met", 1, time.Second)
+	require.NoError(t, err)
+
+	// the arrivals are only read once a wait times out.
+	require.Empty(t, client.Subscriptions())
+}
+
+func TestFormatSeqs(t *testing.T) {
+	require.Equal(t, "4", formatSeqs([]int64{4}))
+	require.Equal(t, "{1-3,5,7-8}", formatSeqs([]int64{1, 2, 3, 5, 7, 8}))
+}
+
+func TestArrivalsTopicScope(t *testing.T) {
+	rp := &runtime.RunParams{TestRun: "run", TestPlan: "plan", TestCase: "case"}
+	state := State("ready")
+
+	run := arrivalsTopic(state).Key(rp)
+	require.Equal(t, "run:run:plan:plan:case:case:topics:arrivals:ready", run)
+	require.Equal(t, "global:topics:arrivals:ready", arrivalsTopic(state.Global()).Key(rp))
+	require.Equal(t, "global:topics:arrivals:@group:a/ready", arrivalsTopic(state.InGroup("a").Global()).Key(rp))
+	require.NotEqual(t, run, arrivalsTopic(state.InGroup("a")).Key(rp))
+}
+
+func TestWatchState(t *testing.T) {
+	startSyncService(t)
+
+	runenv, cleanup := runtime.RandomTestRunEnv(t)
+	t.Cleanup(cleanup)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := NewBoundClient(ctx, runenv)
+	require.NoError(t, err)
+	defer client.Close()
+
+	state := State("progress")
+	client.MustSignalEntry(ctx, state)
+
+	wctx, wcancel := context.WithCancel(ctx)
+	ch, err := client.WatchState(wctx, state)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, <-ch)
+
+	// increments beyond the window are streamed too.
+	for i := 0; i < WatchStateWindow+2; i++ {
+		client.MustSignalEntry(ctx, state)
+	}
+	for i := int64(2); i <= int64(WatchStateWindow+3); i++ {
+		require.Equal(t, i, <-ch)
+	}
+
+	gauge := runenv.D().Gauge(StateProgressGauge + ",state=progress")
+	require.EqualValues(t, WatchStateWindow+3, gauge.Value())
+
+	wcancel()
+	for range ch {
+	}
+}
+
+func TestPublishBatchAndBarrierAll(t *testing.T) {
+	forEachClient(t, func(t *testing.T, client Client) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		topic := NewTopic("batch", "")
+		payloads := []interface{}{"a", "b", "c", "d"}
+		seqs := client.MustPublishBatch(ctx, topic, payloads)
+		require.ElementsMatch(t, []int64{1, 2, 3, 4}, seqs)
+
+		ch := make(chan string, len(payloads))
+		client.MustSubscribe(ctx, topic, ch)
+		got := make(map[int64]string)
+		for i := int64(1); i <= 4; i++ {
+			got[i] = <-ch
+		}
+		for i, seq := range seqs {
+			require.Equal(t, payloads[i], got[seq])
+		}
+
+		_, err := client.PublishBatch(ctx, topic, []interface{}{"e", 1})
+		require.Error(t, err, "mistyped payloads must be rejected")
+
+		b := client.MustBarrierAll(ctx, map[State]int{"x": 1, "y": 2})
+		client.MustSignalEntry(ctx, "x")
+		client.MustSignalEntry(ctx, "y")
+		select {
+		case err := <-b.C:
+			t.Fatalf("barrier fired early: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		client.MustSignalEntry(ctx, "y")
+		require.NoError(t, <-b.C)
+	})
+}
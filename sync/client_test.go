@@ -0,0 +1,209 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/testground/sdk-go/runtime"
+	"github.com/testground/sdk-go/sync/synctest"
+	tgsync "github.com/testground/sync-service"
+)
+
+// startSyncService starts an in-process sync service, and points the sync
+// client at it for the duration of the test.
+func startSyncService(t *testing.T) *synctest.Server {
+	t.Helper()
+
+	srv := synctest.NewServer()
+	t.Cleanup(srv.Close)
+
+	t.Setenv(EnvServiceHost, srv.Host())
+	t.Setenv(EnvServicePort, srv.Port())
+	return srv
+}
+
+// forEachClient runs a test against a fresh bound DefaultClient, connected to
+// an in-process sync service, and against a fresh in-memory client.
+func forEachClient(t *testing.T, test func(t *testing.T, client Client)) {
+	t.Run("inmem", func(t *testing.T) {
+		client := NewInmemHub().NewBoundClient(&runtime.RunParams{TestRun: "run"})
+		defer client.Close()
+		test(t, client)
+	})
+
+	t.Run("default", func(t *testing.T) {
+		startSyncService(t)
+		runenv, cleanup := runtime.RandomTestRunEnv(t)
+		t.Cleanup(cleanup)
+
+		client, err := NewBoundClient(context.Background(), runenv)
+		require.NoError(t, err)
+		defer client.Close()
+		test(t, client)
+	})
+}
+
+func TestReconnectReplaysSubscriptionsAndBarriers(t *testing.T) {
+	srv := startSyncService(t)
+
+	runenv, cleanup := runtime.RandomTestRunEnv(t)
+	t.Cleanup(cleanup)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client, err := NewBoundClient(ctx, runenv)
+	require.NoError(t, err)
+	defer client.Close()
+
+	topic := NewTopic("reconnect", "")
+	ch := make(chan string, 16)
+	sub, err := client.Subscribe(ctx, topic, ch)
+	require.NoError(t, err)
+
+	state := State("reconnect")
+	b, err := client.Barrier(ctx, state, 2)
+	require.NoError(t, err)
+
+	client.MustPublish(ctx, topic, "a")
+	client.MustPublish(ctx, topic, "b")
+	client.MustSignalEntry(ctx, state)
+	require.Equal(t, "a", <-ch)
+	require.Equal(t, "b", <-ch)
+
+	srv.DropConnections()
+
+	// publishes in flight while the connection is down fail; retry them.
+	require.Eventually(t, func() bool {
+		_, err := client.Publish(ctx, topic, "c")
+		return err == nil
+	}, 10*time.Second, 50*time.Millisecond)
+	client.MustSignalEntry(ctx, state)
+
+	select {
+	case v := <-ch:
+		require.Equal(t, "c", v, "entries seen before the reconnection must not be redelivered")
+	case err := <-sub.Done():
+		t.Fatalf("subscription terminated: %v", err)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for entry after reconnection")
+	}
+
+	select {
+	case err := <-b.C:
+		require.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for barrier after reconnection")
+	}
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	srv := startSyncService(t)
+
+	runenv, cleanup := runtime.RandomTestRunEnv(t)
+	t.Cleanup(cleanup)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := NewBoundClient(ctx, runenv)
+	require.NoError(t, err)
+
+	topic := NewTopic("drain", 0)
+	sub, err := client.Subscribe(ctx, topic, make(chan int, 64))
+	require.NoError(t, err)
+
+	// publish concurrently with the shutdown; every publish either makes it,
+	// or is rejected.
+	const n = 32
+	var (
+		wg   gosync.WaitGroup
+		errs = make(chan error, n)
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := client.Publish(ctx, topic, i)
+			errs <- err
+		}(i)
+	}
+
+	require.NoError(t, client.Shutdown(ctx))
+	wg.Wait()
+	close(errs)
+
+	var published int
+	for err := range errs {
+		if err == nil {
+			published++
+			continue
+		}
+		require.True(t, errors.Is(err, ErrClientShutdown), err)
+	}
+	require.Len(t, srv.Entries(topic.Key(&runenv.RunParams)), published)
+
+	require.NoError(t, <-sub.Done())
+	require.True(t, errors.Is(sub.Err(), ErrClientShutdown), sub.Err())
+
+	_, err = client.Publish(ctx, topic, 0)
+	require.True(t, errors.Is(err, ErrClientShutdown), err)
+
+	// idempotent.
+	require.NoError(t, client.Shutdown(ctx))
+	require.NoError(t, client.Close())
+}
+
+func TestRequestIDsAreUnique(t *testing.T) {
+	srv := startSyncService(t)
+
+	runenv, cleanup := runtime.RandomTestRunEnv(t)
+	t.Cleanup(cleanup)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	host, err := os.Hostname()
+	require.NoError(t, err)
+	prefix := runenv.TestRun + "/" + runenv.TestGroupID + "/" + host + "/"
+
+	// two clients, as two processes of the same instance would have.
+	topic := NewTopic("ids", "")
+	for i := 0; i < 2; i++ {
+		client := MustBoundClient(ctx, runenv)
+		client.MustPublish(ctx, topic, "before")
+		srv.DropConnections()
+		require.Eventually(t, func() bool {
+			_, err := client.Publish(ctx, topic, "after")
+			return err == nil
+		}, 10*time.Second, 50*time.Millisecond)
+		require.NoError(t, client.Close())
+	}
+
+	ids := srv.RequestIDs()
+	require.GreaterOrEqual(t, len(ids), 4)
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		require.True(t, strings.HasPrefix(id, prefix), id)
+		require.False(t, seen[id], "duplicate request ID: %s", id)
+		seen[id] = true
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	require.NoError(t, responseError(&tgsync.Response{ID: "a"}))
+
+	err := responseError(&tgsync.Response{ID: "a", Error: ErrConnectionLost.Error()})
+	require.True(t, errors.Is(err, ErrConnectionLost), err)
+
+	var rerr *RequestError
+	require.True(t, errors.As(err, &rerr))
+	require.Equal(t, "a", rerr.ID)
+	require.EqualError(t, err, "sync request a failed: connection to sync service lost")
+}
@@ -2,8 +2,10 @@ package sync
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"reflect"
+
+	tgsync "github.com/testground/sync-service"
 )
 
 // Publish publishes an item on the supplied topic. The payload type must match
@@ -20,7 +22,7 @@ func (c *DefaultClient) Publish(ctx context.Context, topic *Topic, payload inter
 		return -1, ErrNoRunParameters
 	}
 
-	log := c.log.With("topic", topic.name)
+	log := c.logFor(ctx).With("topic", topic.name)
 	log.Debugw("publishing item on topic", "payload", payload)
 
 	if !topic.validatePayload(payload) {
@@ -28,16 +30,77 @@ func (c *DefaultClient) Publish(ctx context.Context, topic *Topic, payload inter
 		return -1, err
 	}
 
+	encoded, err := topic.encodePayload(payload)
+	if err != nil {
+		return -1, err
+	}
+
 	key := topic.Key(rp)
 	log.Debugw("resolved key for publish", "key", key)
 
-	seq, err := c.publish(ctx, key, payload)
+	return c.publish(ctx, key, encoded)
+}
+
+// PublishBatch publishes a batch of items on the supplied topic, pipelining
+// the requests over the connection to the sync service, and returns the
+// sequence number of every item, in the same order as the payloads. All
+// payloads are validated before any is published.
+//
+// The items are not guaranteed to be contiguous, nor to be published in order.
+// If the error is non-nil, some items may have been published nonetheless.
+func (c *DefaultClient) PublishBatch(ctx context.Context, topic *Topic, payloads []interface{}) (seqs []int64, err error) {
+	rp := c.extractor(ctx)
+	if rp == nil {
+		return nil, ErrNoRunParameters
+	}
+
+	if len(payloads) == 0 {
+		return nil, nil
+	}
+
+	key := topic.Key(rp)
+	reqs := make([]*tgsync.Request, 0, len(payloads))
+	for _, payload := range payloads {
+		if !topic.validatePayload(payload) {
+			err := fmt.Errorf("invalid payload type; expected: [*]%s, was: %T", topic.typ, payload)
+			return nil, err
+		}
+
+		encoded, err := topic.encodePayload(payload)
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, &tgsync.Request{
+			PublishRequest: &tgsync.PublishRequest{
+				Topic:   key,
+				Payload: encoded,
+			},
+		})
+	}
+
+	c.logFor(ctx).Debugw("publishing batch on topic", "key", key, "count", len(reqs))
+	defer c.metricsFor(ctx).observe(OpPublishBatch)()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chs, err := c.makeRequests(ctx, reqs)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 
-	c.log.Debugw("successfully published item; sequence number obtained", "seq", seq)
-	return seq, nil
+	seqs = make([]int64, 0, len(chs))
+	for _, ch := range chs {
+		res, ok := <-ch
+		if !ok {
+			return nil, errors.New("channel closed before getting response")
+		}
+		if err := responseError(res); err != nil {
+			return nil, err
+		}
+		seqs = append(seqs, int64(res.PublishResponse.Seq))
+	}
+	return seqs, nil
 }
 
 // Subscribe subscribes to a topic, consuming ordered, typed elements from
@@ -47,28 +110,24 @@ func (c *DefaultClient) Publish(ctx context.Context, topic *Topic, payload inter
 // pointer type matching the topic type. If these conditions are unmet, this
 // method will error immediately.
 //
-// The caller must consume from this channel promptly; failure to do so will
-// backpressure the DefaultClient's subscription event loop.
-func (c *DefaultClient) Subscribe(ctx context.Context, topic *Topic, ch interface{}) (sub *Subscription, err error) {
+// The caller must consume from this channel promptly. Entries not yet
+// consumed are buffered, up to SubscriptionBuffer of them; once the buffer is
+// full, the subscription fails with ErrSubscriptionOverflow, unless a
+// different overflow policy is set through the WithBuffer option.
+//
+// Entries that fail to decode are skipped and counted by default; use the
+// FailOnDecodeError or WithDeadLetters options to handle them otherwise.
+func (c *DefaultClient) Subscribe(ctx context.Context, topic *Topic, ch interface{}, opts ...SubscribeOption) (sub *Subscription, err error) {
 	rp := c.extractor(ctx)
 	if rp == nil {
 		return nil, ErrNoRunParameters
 	}
 
-	chv := reflect.ValueOf(ch)
-	if k := chv.Kind(); k != reflect.Chan {
-		return nil, fmt.Errorf("value is not a channel: %T", ch)
-	}
-
-	// compare the naked types; this makes the subscription work with pointer
-	// or value channels.
-	var deref bool
-	chtyp := chv.Type().Elem()
-	if chtyp.Kind() == reflect.Ptr {
-		chtyp = chtyp.Elem()
-	} else {
-		deref = true
+	key := topic.Key(rp)
+	sink, err := newSink(key, topic.typeValidator, ch, opts...)
+	if err != nil {
+		return nil, err
 	}
 
-	return c.subscribe(ctx, topic.Key(rp), deref, topic.typeValidator, ch)
+	return c.subscribe(ctx, key, sink)
 }
@@ -0,0 +1,173 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrCodecMismatch is returned when a topic entry was encoded with a codec
+// other than the one configured on the Topic it is being decoded with.
+var ErrCodecMismatch = errors.New("codec mismatch")
+
+// Codec encodes and decodes the payloads of a Topic. See Topic.WithCodec.
+type Codec interface {
+	// Name identifies the codec. It travels alongside every payload encoded
+	// with this codec, so that mismatches can be detected by subscribers.
+	Name() string
+
+	// Marshal encodes a payload.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Unmarshal decodes data into v, which is always a pointer to a value of
+	// the Topic type.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSONCodec encodes payloads as JSON. It is the default codec, and the
+	// only one whose payloads travel as-is, without naming the codec.
+	JSONCodec Codec = jsonCodec{}
+
+	// RawCodec carries []byte payloads verbatim; they travel base64-encoded.
+	RawCodec Codec = rawCodec{}
+
+	// ProtobufCodec encodes payloads implementing proto.Message in the
+	// protobuf wire format.
+	ProtobufCodec Codec = protobufCodec{}
+
+	// CBORCodec encodes payloads in CBOR.
+	CBORCodec Codec = cborCodec{}
+)
+
+// envelope wraps payloads encoded with codecs other than JSONCodec, so that
+// the codec name travels alongside the payload.
+type envelope struct {
+	Codec string `json:"tg_codec"`
+	Data  []byte `json:"tg_data"`
+}
+
+// envelopeMarker is used to cheaply discard entries that are certainly not
+// envelopes before trying to parse them as such.
+const envelopeMarker = `"tg_codec"`
+
+// encode encodes a payload with the codec, and wraps it in an envelope,
+// unless the codec is JSONCodec.
+func encode(codec Codec, payload interface{}) (interface{}, error) {
+	if codec == nil || codec.Name() == JSONCodec.Name() {
+		return payload, nil
+	}
+
+	data, err := codec.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode payload with codec %s: %w", codec.Name(), err)
+	}
+	return &envelope{Codec: codec.Name(), Data: data}, nil
+}
+
+// decode decodes a raw topic entry into v with the codec, verifying that it
+// was encoded with that same codec.
+func decode(codec Codec, raw string, v interface{}) error {
+	if codec == nil {
+		codec = JSONCodec
+	}
+
+	var env envelope
+	if strings.Contains(raw, envelopeMarker) {
+		// a failure to parse just means it's not an envelope.
+		_ = json.Unmarshal([]byte(raw), &env)
+	}
+
+	got := env.Codec
+	if got == "" {
+		got = JSONCodec.Name()
+	}
+	if got != codec.Name() {
+		return fmt.Errorf("%w: expected %s, entry encoded with %s", ErrCodecMismatch, codec.Name(), got)
+	}
+
+	if env.Codec == "" {
+		return codec.Unmarshal([]byte(raw), v)
+	}
+	return codec.Unmarshal(env.Data, v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type rawCodec struct{}
+
+func (rawCodec) Name() string {
+	return "raw"
+}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch b := v.(type) {
+	case []byte:
+		return b, nil
+	case *[]byte:
+		return *b, nil
+	default:
+		return nil, fmt.Errorf("raw codec only accepts []byte payloads, got %T", v)
+	}
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("raw codec can only decode into *[]byte, got %T", v)
+	}
+	*b = data
+	return nil
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protobuf codec only accepts proto.Message payloads, got %T", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protobuf codec can only decode into proto.Message, got %T", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string {
+	return "cbor"
+}
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (cborCodec) Unmarshal(data []byte, v interface{}) error {
+	return cbor.Unmarshal(data, v)
+}
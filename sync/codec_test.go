@@ -0,0 +1,75 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/testground/sdk-go/runtime"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestCodecsRoundtrip(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := NewInmemHub().NewBoundClient(&runtime.RunParams{TestRun: "run"})
+	defer client.Close()
+
+	t.Run("raw", func(t *testing.T) {
+		topic := NewTopic("raw", []byte{}).WithCodec(RawCodec)
+		client.MustPublish(ctx, topic, []byte{0xde, 0xad, 0xbe, 0xef})
+
+		ch := make(chan []byte, 1)
+		client.MustSubscribe(ctx, topic, ch)
+		require.Equal(t, []byte{0xde, 0xad, 0xbe, 0xef}, <-ch)
+	})
+
+	t.Run("protobuf", func(t *testing.T) {
+		topic := NewTypedTopic[*wrapperspb.StringValue](client, "protobuf").WithCodec(ProtobufCodec)
+		topic.MustPublish(ctx, wrapperspb.String("bafybeigdyrzt"))
+
+		ch, _ := topic.MustSubscribe(ctx)
+		require.True(t, proto.Equal(wrapperspb.String("bafybeigdyrzt"), <-ch))
+	})
+
+	t.Run("cbor", func(t *testing.T) {
+		type record struct {
+			Key   string
+			Value []byte
+		}
+		topic := NewTypedTopic[record](client, "cbor").WithCodec(CBORCodec)
+		topic.MustPublish(ctx, record{"k", []byte("v")})
+
+		ch, _ := topic.MustSubscribe(ctx)
+		require.Equal(t, record{"k", []byte("v")}, <-ch)
+	})
+}
+
+func TestCodecMismatch(t *testing.T) {
+	encoded, err := encode(CBORCodec, "hello")
+	require.NoError(t, err)
+	raw, err := JSONCodec.Marshal(encoded)
+	require.NoError(t, err)
+
+	var s string
+	err = decode(CBORCodec, string(raw), &s)
+	require.NoError(t, err)
+	require.Equal(t, "hello", s)
+
+	// a JSON topic must not silently decode an envelope.
+	err = decode(JSONCodec, string(raw), &s)
+	require.True(t, errors.Is(err, ErrCodecMismatch), err)
+
+	// nor a CBOR topic a plain JSON entry.
+	err = decode(CBORCodec, `"hello"`, &s)
+	require.True(t, errors.Is(err, ErrCodecMismatch), err)
+
+	// nor a raw topic a CBOR one.
+	var b []byte
+	err = decode(RawCodec, string(raw), &b)
+	require.True(t, errors.Is(err, ErrCodecMismatch), err)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/testground/sdk-go/runtime"
+	"go.uber.org/zap"
 )
 
 type runparamsCtxKey struct{}
@@ -25,3 +26,61 @@ func GetRunParams(ctx context.Context) *runtime.RunParams {
 	}
 	return v.(*runtime.RunParams)
 }
+
+// detach returns a context that carries the RunParams and the binding of the
+// supplied context, if any, but is never cancelled. It is used to clean up
+// after an operation whose context fired, and for operations that outlive the
+// context that starts them.
+func detach(ctx context.Context) context.Context {
+	detached := context.Background()
+	if rp := GetRunParams(ctx); rp != nil {
+		detached = WithRunParams(detached, rp)
+	}
+	if b := bindingOf(ctx); b != nil {
+		detached = withBinding(detached, b)
+	}
+	return detached
+}
+
+type bindingCtxKey struct{}
+
+var bindingKey = bindingCtxKey{}
+
+// binding overrides, for the requests issued with a context, where a
+// DefaultClient reports them. The shared clients of NewSharedClient issue
+// their requests through a connection shared by several RunEnvs, each with a
+// binding of its own.
+type binding struct {
+	log     *zap.SugaredLogger
+	runenv  *runtime.RunEnv
+	metrics *instruments
+	// done is closed when the client that issued the requests is closed.
+	done <-chan struct{}
+}
+
+// newBinding returns a binding that reports to the supplied RunEnv, for a
+// client that is closed when done is.
+func newBinding(runenv *runtime.RunEnv, done <-chan struct{}) *binding {
+	return &binding{log: runenv.SLogger(), runenv: runenv, metrics: newInstruments(runenv), done: done}
+}
+
+// closed returns whether the client that issued the requests was closed.
+func (b *binding) closed() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// withBinding returns a context that carries the supplied binding.
+func withBinding(ctx context.Context, b *binding) context.Context {
+	return context.WithValue(ctx, bindingKey, b)
+}
+
+// bindingOf returns the binding carried by a context, or nil.
+func bindingOf(ctx context.Context) *binding {
+	b, _ := ctx.Value(bindingKey).(*binding)
+	return b
+}
@@ -19,6 +19,15 @@
 // runtime.RunParams in the context.Context to all operations. See WithRunParams
 // for more info.
 //
+// Libraries used within a test plan can obtain a client through
+// sync.NewSharedClient, which shares a reference-counted connection to the
+// sync service with the client of the InitContext, instead of opening a new
+// one.
+//
+// For local simulations and unit tests, sync.NewInmemHub creates an in-process
+// stand-in for the sync service, to which clients bound to the RunParams of
+// each simulated instance can be attached.
+//
 // Recommendations for test plan writers
 //
 // All constructors and methods on sync.DefaultClient have Must* versions, which panic
@@ -31,6 +40,99 @@
 // client.PublishAndWait, etc. These katas also have Must* variations. We
 // encourage developers to adopt them in order to streamline their code.
 //
+// client.SignalAndWaitTimeout bounds the wait on a barrier; when it times out,
+// the returned BarrierTimeoutError reports which instances are missing.
+// client.WatchState streams the progress of a state counter.
+//
+// Higher-level primitives are built on top of these: ElectLeader, Semaphore
+// (and NewMutex), Counter, which supports compare-and-swap, and KV, a
+// key/value store with revisions.
+//
+// Plans made of a sequence of phases can declare them with sync.NewPhases.
+// Phases.Run (or Phases.Enter) walks all instances through the phases in
+// lockstep, emitting stage events and recording the duration of every phase
+// in the results; if an instance fails a phase, every instance aborts with a
+// PhaseAbortedError.
+//
+// Topics can be declared with sync.NewTypedTopic, which binds them to a client
+// and to a Go type, so that publishing and subscribing are checked at compile
+// time rather than at runtime.
+//
+// States and topics are scoped to the run, plan and case. Use InGroup to scope
+// them to a group of instances, and Global to share them across runs.
+//
+// Subscriptions replay a topic from its first entry. For long topics, use the
+// StartAt option to skip part of the history; the in-memory client also
+// supports LiveOnly and ReplayLast.
+// Entries that the subscriber has yet to consume are buffered; WithBuffer
+// sizes the buffer, and chooses whether to block, drop entries, or fail when
+// it overflows. By default, a subscription fails when its buffer overflows, so
+// that a slow subscriber cannot hold up the rest of the client.
+//
+// A subscription ends when the context passed to Subscribe fires, or when
+// Subscription.Cancel is called. With the CloseOnDone option, the channel is
+// then closed, and Subscription.Err tells why. Client.Subscriptions lists the
+// active subscriptions; those still active when the client is closed are
+// logged, as they were likely leaked.
+//
+// Transports
+//
+// By default, the sync.DefaultClient talks to the sync service over a
+// websocket. NewBoundClientWithDialer and NewGenericClientWithDialer accept a
+// Dialer for a different Transport: a websocket over TLS (wss://), TCP with
+// length-prefixed framing (tcp://), or Redis streams (redis://), which lets
+// instances coordinate through a Redis server when the sync service is not
+// available. DialerFor picks the Dialer from the scheme of an address.
+//
+// NewBoundClientWithOptions and NewGenericClientWithOptions take ClientOptions
+// to set the address, TLS configuration, auth token, and dial and read
+// timeouts explicitly. Invalid options are reported as errors.
+//
+// Reconnection
+//
+// If the connection to the sync service drops, the sync.DefaultClient redials
+// with exponential backoff (see the Reconnect* variables). Subscriptions resume
+// from the last entry they delivered, and pending barriers are re-issued.
+// Publishes and signals that were in flight fail with ErrConnectionLost, as it
+// is unknown whether the sync service processed them.
+//
+// DefaultClient.Shutdown closes a client gracefully: it rejects new requests
+// with ErrClientShutdown, waits for in-flight publishes and signals to be
+// acknowledged, and then ends the active subscriptions with ErrClientShutdown,
+// which tells them apart from those ended by Close (ErrClientClosed).
+//
+// Every request carries an ID of the form <run>/<group>/<host>/<nonce>-<n>,
+// unique across instances, processes and reconnections. The client logs these
+// IDs, and failed requests return a RequestError carrying them, so that the
+// logs of an instance can be joined with those of the sync service.
+//
+// Instrumentation
+//
+// The sync.DefaultClient times its requests to the sync service, and counts
+// those in flight, both in Prometheus collectors served on the /metrics
+// endpoint of the test plan, and, for bound clients, in the RunEnv.D()
+// diagnostics. See RequestDurationTimer and friends.
+//
+// Interceptors
+//
+// sync.WithInterceptors wraps a client with a chain of interceptors, which see
+// every call to its elemental operations, including those made by the sugar
+// methods. LoggingInterceptor and FaultInjectionInterceptor are provided.
+//
+// Chaos mode
+//
+// Setting the sync_chaos_* instance parameters (see the Chaos*Param constants)
+// makes the client handed out by the run package drop or delay publishes,
+// duplicate deliveries, and delay barrier releases, to verify that a test plan
+// tolerates a misbehaving sync service. sync.WithChaos applies the same
+// configuration to any client.
+//
+// Record and replay
+//
+// sync.NewRecordingClient decorates a client, recording all its traffic in a
+// RunEnv asset. sync.NewReplayClient feeds that recording back to a single
+// instance offline, to reproduce its view of a failed run.
+//
 // Garbage collection
 //
 // The sync service is decentralised: it has no centralised actor, dispatcher,
@@ -3,30 +3,50 @@ package sync
 import (
 	"context"
 	"io"
+	"time"
 
 	"github.com/testground/sdk-go/runtime"
 )
 
+// Names of the elemental operations of a Client, as reported to interceptors
+// and in metrics.
+const (
+	OpPublish      = "publish"
+	OpPublishBatch = "publish_batch"
+	OpSubscribe    = "subscribe"
+	OpBarrier      = "barrier"
+	OpSignalEntry  = "signal_entry"
+	OpSignalEvent  = "signal_event"
+)
+
 type Client interface {
 	io.Closer
 
 	Publish(ctx context.Context, topic *Topic, payload interface{}) (seq int64, err error)
-	Subscribe(ctx context.Context, topic *Topic, ch interface{}) (*Subscription, error)
+	PublishBatch(ctx context.Context, topic *Topic, payloads []interface{}) (seqs []int64, err error)
+	Subscribe(ctx context.Context, topic *Topic, ch interface{}, opts ...SubscribeOption) (*Subscription, error)
+	Subscriptions() []*Subscription
 	PublishAndWait(ctx context.Context, topic *Topic, payload interface{}, state State, target int) (seq int64, err error)
-	PublishSubscribe(ctx context.Context, topic *Topic, payload interface{}, ch interface{}) (seq int64, sub *Subscription, err error)
+	PublishSubscribe(ctx context.Context, topic *Topic, payload interface{}, ch interface{}, opts ...SubscribeOption) (seq int64, sub *Subscription, err error)
 
 	Barrier(ctx context.Context, state State, target int) (*Barrier, error)
+	BarrierAll(ctx context.Context, targets map[State]int) (*Barrier, error)
 	SignalEntry(ctx context.Context, state State) (after int64, err error)
 	SignalAndWait(ctx context.Context, state State, target int) (seq int64, err error)
+	SignalAndWaitTimeout(ctx context.Context, state State, target int, timeout time.Duration) (seq int64, err error)
+	WatchState(ctx context.Context, state State) (<-chan int64, error)
 
 	MustBarrier(ctx context.Context, state State, target int) *Barrier
+	MustBarrierAll(ctx context.Context, targets map[State]int) *Barrier
 	MustSignalEntry(ctx context.Context, state State) int64
-	MustSubscribe(ctx context.Context, topic *Topic, ch interface{}) *Subscription
+	MustSubscribe(ctx context.Context, topic *Topic, ch interface{}, opts ...SubscribeOption) *Subscription
 	MustPublish(ctx context.Context, topic *Topic, payload interface{}) (seq int64)
+	MustPublishBatch(ctx context.Context, topic *Topic, payloads []interface{}) (seqs []int64)
 
 	MustPublishAndWait(ctx context.Context, topic *Topic, payload interface{}, state State, target int) (seq int64)
-	MustPublishSubscribe(ctx context.Context, topic *Topic, payload interface{}, ch interface{}) (seq int64, sub *Subscription)
+	MustPublishSubscribe(ctx context.Context, topic *Topic, payload interface{}, ch interface{}, opts ...SubscribeOption) (seq int64, sub *Subscription)
 	MustSignalAndWait(ctx context.Context, state State, target int) (seq int64)
+	MustSignalAndWaitTimeout(ctx context.Context, state State, target int, timeout time.Duration) (seq int64)
 
 	SignalEvent(context.Context, *runtime.Event) error
 }
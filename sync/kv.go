@@ -0,0 +1,204 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ErrKeyNotFound is returned by KV.Get when the key has never been set, or
+// has been deleted.
+var ErrKeyNotFound = errors.New("key not found")
+
+// KV is a key/value store shared by all the instances that construct it with
+// the same name. Like topics and states, it is namespaced to the run, plan
+// and case.
+//
+// Every mutation is assigned a revision, which increases monotonically, but
+// not necessarily contiguously, across all keys of the store.
+//
+// It is implemented as a log of mutations on a Topic, which every KV follows
+// to maintain a local view of the store once it is first read. Reads are
+// served from that view, without writing to the log: they observe the writes
+// made through the same KV, and those of other instances received so far. Call
+// Sync before reading to observe all writes that completed before. If the log
+// can no longer be followed, reads fail rather than serve a stale view. Close
+// the KV to stop following the log.
+type KV struct {
+	client Client
+	topic  *Topic
+	view   *logView[kvOp]
+
+	// guarded by view.mu.
+	entries map[string]*KVEntry
+	written int64 // highest revision written through this KV
+}
+
+// KVEntry is a revision of a key.
+type KVEntry struct {
+	Key      string
+	Value    []byte
+	Revision int64
+	// Deleted is set if this revision deletes the key.
+	Deleted bool
+}
+
+type kvOp struct {
+	Key    string `json:"key,omitempty"`
+	Value  []byte `json:"value,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+// NewKV constructs a KV store with the provided name.
+func NewKV(client Client, name string) *KV {
+	kv := &KV{
+		client:  client,
+		topic:   NewTopic("kv:"+name, &kvOp{}),
+		entries: make(map[string]*KVEntry),
+	}
+	kv.view = newLogView(client, kv.topic, kv.apply)
+	return kv
+}
+
+// apply applies an entry of the log to the local view. Markers, without a
+// key, are skipped.
+func (kv *KV) apply(seq int64, op *kvOp) {
+	if op.Key != "" {
+		kv.entries[op.Key] = &KVEntry{Key: op.Key, Value: op.Value, Revision: seq, Deleted: op.Delete}
+	}
+}
+
+// Put sets the value of a key, returning the revision of the write.
+func (kv *KV) Put(ctx context.Context, key string, value []byte) (rev int64, err error) {
+	if key == "" {
+		return -1, errors.New("empty key")
+	}
+	return kv.write(ctx, &kvOp{Key: key, Value: value})
+}
+
+// Delete deletes a key, returning the revision of the deletion.
+func (kv *KV) Delete(ctx context.Context, key string) (rev int64, err error) {
+	if key == "" {
+		return -1, errors.New("empty key")
+	}
+	return kv.write(ctx, &kvOp{Key: key, Delete: true})
+}
+
+func (kv *KV) write(ctx context.Context, op *kvOp) (rev int64, err error) {
+	rev, err = publishEntry(ctx, kv.client, kv.topic, op)
+	if err != nil {
+		return -1, err
+	}
+
+	kv.view.mu.Lock()
+	if rev > kv.written {
+		kv.written = rev
+	}
+	kv.view.mu.Unlock()
+	return rev, nil
+}
+
+// Get returns the latest revision of a key in the local view of the store, or
+// ErrKeyNotFound. It waits until the view reflects the writes made through
+// this KV; see Sync to also observe those of other instances.
+func (kv *KV) Get(ctx context.Context, key string) (*KVEntry, error) {
+	kv.view.mu.Lock()
+	rev := kv.written
+	kv.view.mu.Unlock()
+
+	if err := kv.view.wait(ctx, rev); err != nil {
+		return nil, err
+	}
+
+	kv.view.mu.Lock()
+	e := kv.entries[key]
+	kv.view.mu.Unlock()
+
+	if e == nil || e.Deleted {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+	cp := *e
+	return &cp, nil
+}
+
+// Sync waits until the local view of the store reflects all writes that
+// completed before the call, by any instance. It appends a marker to the log
+// to that end.
+func (kv *KV) Sync(ctx context.Context) error {
+	if err := kv.view.follow(ctx); err != nil {
+		return err
+	}
+	// a marker is an operation without a key.
+	marker, err := publishEntry(ctx, kv.client, kv.topic, &kvOp{})
+	if err != nil {
+		return err
+	}
+	return kv.view.wait(ctx, marker)
+}
+
+// Close stops following the log. Reads fail from then on.
+func (kv *KV) Close() {
+	kv.view.close()
+}
+
+// Watch streams every revision of a key, starting with the first, including
+// deletions. An empty key watches all keys of the store.
+//
+// The channel is closed when the returned Subscription ends, after all the
+// revisions received have been delivered; Subscription.Err tells why.
+func (kv *KV) Watch(ctx context.Context, key string) (<-chan *KVEntry, *Subscription, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	ch := make(chan *kvOp, 64)
+	sub, err := kv.client.Subscribe(ctx, kv.topic, ch, FailOnDecodeError())
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	out := make(chan *KVEntry)
+	watch := newSubscription(sub.Topic(), cancel)
+	watch.ch = reflect.ValueOf(out)
+
+	go func() {
+		seq := int64(0)
+		forward := func(op *kvOp) bool {
+			seq++
+			if op.Key == "" || (key != "" && op.Key != key) {
+				return true
+			}
+			select {
+			case out <- &KVEntry{Key: op.Key, Value: op.Value, Revision: seq, Deleted: op.Delete}:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for {
+			select {
+			case op := <-ch:
+				if !forward(op) {
+					<-sub.Done()
+					watch.finish(nil, sub.Err())
+					return
+				}
+			case err := <-sub.Done():
+				// deliver the entries received before the end.
+				for drained := false; !drained; {
+					select {
+					case op := <-ch:
+						drained = !forward(op)
+					default:
+						drained = true
+					}
+				}
+				watch.finish(err, sub.Err())
+				return
+			}
+		}
+	}()
+
+	return out, watch, nil
+}
@@ -0,0 +1,143 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/testground/sdk-go/runtime"
+)
+
+func TestKV(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clients := newInmemInstances(2)
+	a, b := NewKV(clients[0], "config"), NewKV(clients[1], "config")
+	defer a.Close()
+	defer b.Close()
+
+	_, err := b.Get(ctx, "addr")
+	require.True(t, errors.Is(err, ErrKeyNotFound), err)
+
+	watch, _, err := b.Watch(ctx, "addr")
+	require.NoError(t, err)
+
+	rev1, err := a.Put(ctx, "addr", []byte("10.0.0.1"))
+	require.NoError(t, err)
+	_, err = a.Put(ctx, "port", []byte("4001"))
+	require.NoError(t, err)
+	rev2, err := a.Put(ctx, "addr", []byte("10.0.0.2"))
+	require.NoError(t, err)
+	require.Greater(t, rev2, rev1)
+
+	require.NoError(t, b.Sync(ctx))
+	e, err := b.Get(ctx, "addr")
+	require.NoError(t, err)
+	require.Equal(t, &KVEntry{Key: "addr", Value: []byte("10.0.0.2"), Revision: rev2}, e)
+
+	rev3, err := b.Delete(ctx, "addr")
+	require.NoError(t, err)
+	require.NoError(t, a.Sync(ctx))
+	_, err = a.Get(ctx, "addr")
+	require.True(t, errors.Is(err, ErrKeyNotFound), err)
+
+	for _, want := range []*KVEntry{
+		{Key: "addr", Value: []byte("10.0.0.1"), Revision: rev1},
+		{Key: "addr", Value: []byte("10.0.0.2"), Revision: rev2},
+		{Key: "addr", Revision: rev3, Deleted: true},
+	} {
+		require.Equal(t, want, <-watch)
+	}
+}
+
+func TestKVReadsDontWrite(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := newInmemInstances(1)[0]
+	kv := NewKV(client, "reads")
+	defer kv.Close()
+
+	rev, err := kv.Put(ctx, "k", []byte("v"))
+	require.NoError(t, err)
+
+	// reads observe the writes made through the same KV, without appending to
+	// the log.
+	for i := 0; i < 10; i++ {
+		e, err := kv.Get(ctx, "k")
+		require.NoError(t, err)
+		require.Equal(t, rev, e.Revision)
+	}
+	rp := client.extractor(ctx)
+	require.Equal(t, 1, client.hub.length(kv.topic.Key(rp)))
+}
+
+func TestKVWatchEnd(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clients := newInmemInstances(1)
+	kv := NewKV(clients[0], "watch")
+
+	for _, v := range []string{"a", "b", "c"} {
+		_, err := kv.Put(ctx, "k", []byte(v))
+		require.NoError(t, err)
+	}
+
+	watch, sub, err := kv.Watch(ctx, "k")
+	require.NoError(t, err)
+
+	// closing the client ends the watch, but the revisions received are still
+	// delivered, and the channel is then closed.
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, clients[0].Close())
+
+	var values []string
+	for e := range watch {
+		values = append(values, string(e.Value))
+	}
+	require.Equal(t, []string{"a", "b", "c"}, values)
+	require.True(t, errors.Is(sub.Err(), ErrClientClosed), sub.Err())
+}
+
+func TestKVFollowFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := newInmemInstances(1)[0]
+	kv := NewKV(client, "broken")
+	defer kv.Close()
+
+	_, err := kv.Put(ctx, "k", []byte("v"))
+	require.NoError(t, err)
+	_, err = kv.Get(ctx, "k")
+	require.NoError(t, err)
+
+	// an entry that can't be decoded ends the view; reads fail from then on,
+	// rather than serve a stale view.
+	client.MustPublish(ctx, NewTopic("kv:broken", ""), "garbage")
+	require.Eventually(t, func() bool {
+		_, err := kv.Get(ctx, "k")
+		return err != nil && !errors.Is(err, ErrKeyNotFound)
+	}, time.Second, 10*time.Millisecond)
+
+	var derr *DecodeError
+	_, err = kv.Get(ctx, "k")
+	require.True(t, errors.As(err, &derr), err)
+}
+
+func TestDetachKeepsBinding(t *testing.T) {
+	rp := &runtime.RunParams{TestRun: "run"}
+	b := &binding{}
+
+	ctx, cancel := context.WithCancel(withBinding(WithRunParams(context.Background(), rp), b))
+	cancel()
+
+	detached := detach(ctx)
+	require.NoError(t, detached.Err())
+	require.Same(t, rp, GetRunParams(detached))
+	require.Same(t, b, bindingOf(detached))
+}
@@ -0,0 +1,334 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/testground/sdk-go/runtime"
+)
+
+// PhaseDurationTimer is the name of the result timer, in RunEnv.R(), where
+// Phases records how long the instance spent in every phase it completed. It
+// is tagged with the name of the phase.
+const PhaseDurationTimer = "sync.phase.duration"
+
+// phasesScope returns a hash of the supplied phases, which scopes the states
+// and topics of the plan that declares them. Phases declared alike share it,
+// so that they don't interfere with the phases of other plans.
+func phasesScope(phases []Phase) string {
+	h := fnv.New64a()
+	for _, phase := range phases {
+		_, _ = h.Write([]byte(phase))
+		_, _ = h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// phaseAbortTopic returns the topic where instances report the phases they
+// fail, for the plan that declares the supplied phases.
+func phaseAbortTopic(phases []Phase) *Topic {
+	return NewTopic("phases:abort:"+phasesScope(phases), &PhaseAbortedError{})
+}
+
+// Phase is a phase of a test plan, like "bootstrap" or "teardown".
+type Phase string
+
+// PhaseAbortedError is returned by the Phases of every instance once any of
+// them fails a phase.
+type PhaseAbortedError struct {
+	// Phase is the phase that failed.
+	Phase Phase `json:"phase"`
+	// GroupID is the group of the instance that failed it.
+	GroupID string `json:"group"`
+	// Reason is the error the instance failed with.
+	Reason string `json:"reason"`
+}
+
+func (e *PhaseAbortedError) Error() string {
+	return fmt.Sprintf("phase %s aborted by an instance of group %s: %s", e.Phase, e.GroupID, e.Reason)
+}
+
+// Phases walks an instance through the ordered phases of a test plan, in
+// lockstep with all other instances of the run: no instance enters a phase
+// until all of them have completed the previous one.
+//
+// Entering a phase signals its state and waits for all instances to do the
+// same, and then emits a StageStartEvent; leaving it, or failing it, emits a
+// StageEndEvent, and records its duration under the PhaseDurationTimer. If an
+// instance fails a phase, the phases declared alike are aborted for all
+// instances.
+//
+// A Phases must be driven from a single goroutine; only Fail, Err and Aborted
+// may be called concurrently.
+type Phases struct {
+	client Client
+	runenv *runtime.RunEnv
+	phases []Phase
+	scope  string // see phasesScope
+	topic  *Topic // where failures are reported
+
+	// ctx is cancelled when the phases are closed, or aborted.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	abortCh chan struct{}
+
+	mu      sync.Mutex
+	next    int       // index of the next phase to enter
+	current Phase     // the phase being entered, or in progress
+	started time.Time // when the current phase started; zero while entering
+	aborted *PhaseAbortedError
+}
+
+// NewPhases declares the ordered phases of a test plan, which every instance
+// of the run must declare alike. It watches for failures reported by other
+// instances until the phases are finished or closed, or the context fires;
+// those of phases declared otherwise are ignored.
+func NewPhases(ctx context.Context, client Client, runenv *runtime.RunEnv, phases ...Phase) (*Phases, error) {
+	if len(phases) == 0 {
+		return nil, errors.New("no phases declared")
+	}
+	seen := make(map[Phase]bool, len(phases))
+	for _, phase := range phases {
+		if seen[phase] {
+			return nil, fmt.Errorf("phase %s declared more than once", phase)
+		}
+		seen[phase] = true
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	p := &Phases{
+		client:  client,
+		runenv:  runenv,
+		phases:  phases,
+		scope:   phasesScope(phases),
+		topic:   phaseAbortTopic(phases),
+		ctx:     ctx,
+		cancel:  cancel,
+		abortCh: make(chan struct{}),
+	}
+
+	ch := make(chan *PhaseAbortedError, 1)
+	if _, err := client.Subscribe(ctx, p.topic, ch); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to subscribe to phase failures: %w", err)
+	}
+	go func() {
+		select {
+		case e := <-ch:
+			p.abort(e)
+		case <-ctx.Done():
+		}
+	}()
+
+	return p, nil
+}
+
+// State returns the state that instances signal when entering the phase. It
+// is scoped to the declared phases, like failures are.
+func (p *Phases) State(phase Phase) State {
+	return State(fmt.Sprintf("phases:%s:%s", p.scope, phase))
+}
+
+// Enter enters the next phase, which must be the supplied one, leaving the
+// current phase, if any. It returns once all instances have entered the
+// phase, or with a *PhaseAbortedError if the phases are aborted meanwhile.
+func (p *Phases) Enter(ctx context.Context, phase Phase) error {
+	if err := p.Err(); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	if p.next >= len(p.phases) {
+		p.mu.Unlock()
+		return fmt.Errorf("cannot enter phase %s; all phases were entered", phase)
+	}
+	if expected := p.phases[p.next]; phase != expected {
+		p.mu.Unlock()
+		return fmt.Errorf("cannot enter phase %s; the next phase is %s", phase, expected)
+	}
+	p.next++
+	p.mu.Unlock()
+
+	if err := p.leave(ctx); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.current = phase
+	p.mu.Unlock()
+
+	wctx, cancel := p.context(ctx)
+	defer cancel()
+
+	if _, err := p.client.SignalAndWait(wctx, p.State(phase), p.runenv.TestInstanceCount); err != nil {
+		if aerr := p.Err(); aerr != nil {
+			return aerr
+		}
+		return fmt.Errorf("failed to enter phase %s: %w", phase, err)
+	}
+
+	p.mu.Lock()
+	p.started = time.Now()
+	p.mu.Unlock()
+
+	return p.client.SignalEvent(ctx, &runtime.Event{StageStartEvent: &runtime.StageStartEvent{
+		Name:        string(phase),
+		TestGroupID: p.runenv.TestGroupID,
+	}})
+}
+
+// MustEnter calls Enter, panicking if it errors.
+//
+// Suitable for shorthanding in test plans.
+func (p *Phases) MustEnter(ctx context.Context, phase Phase) {
+	if err := p.Enter(ctx, phase); err != nil {
+		panic(err)
+	}
+}
+
+// Finish leaves the current phase, and closes the phases.
+func (p *Phases) Finish(ctx context.Context) error {
+	defer p.Close()
+
+	if err := p.Err(); err != nil {
+		return err
+	}
+	return p.leave(ctx)
+}
+
+// Fail aborts the phases for all instances, reporting that this instance
+// failed the current phase with the supplied error. Enter and Run return a
+// *PhaseAbortedError from then on, in every instance.
+func (p *Phases) Fail(ctx context.Context, err error) error {
+	p.mu.Lock()
+	e := &PhaseAbortedError{
+		Phase:   p.current,
+		GroupID: p.runenv.TestGroupID,
+		Reason:  err.Error(),
+	}
+	p.mu.Unlock()
+
+	p.abort(e)
+	if _, err := publishEntry(ctx, p.client, p.topic, e); err != nil {
+		return fmt.Errorf("failed to report failure of phase %s: %w", e.Phase, err)
+	}
+	return nil
+}
+
+// Run enters every phase in order, calling fn in each, and then finishes. If
+// fn errors, Run fails the phase with that error. The context passed to fn is
+// cancelled if the phases are aborted by another instance, in which case Run
+// returns a *PhaseAbortedError. Either way, Run leaves the phase before
+// returning.
+func (p *Phases) Run(ctx context.Context, fn func(ctx context.Context, phase Phase) error) error {
+	defer p.Close()
+
+	for _, phase := range p.phases {
+		if err := p.Enter(ctx, phase); err != nil {
+			return err
+		}
+
+		pctx, cancel := p.context(ctx)
+		err := fn(pctx, phase)
+		cancel()
+
+		if aerr := p.Err(); aerr != nil {
+			p.leaveFailed(ctx, phase)
+			return aerr
+		}
+		if err != nil {
+			if ferr := p.Fail(ctx, err); ferr != nil {
+				p.runenv.SLogger().Warnw("failed to abort phases", "phase", phase, "error", ferr)
+			}
+			p.leaveFailed(ctx, phase)
+			return fmt.Errorf("phase %s failed: %w", phase, err)
+		}
+	}
+	return p.Finish(ctx)
+}
+
+// Err returns a *PhaseAbortedError if the phases were aborted, or nil.
+func (p *Phases) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.aborted == nil {
+		return nil
+	}
+	return p.aborted
+}
+
+// Aborted returns a channel that is closed when the phases are aborted.
+func (p *Phases) Aborted() <-chan struct{} {
+	return p.abortCh
+}
+
+// Close stops watching for failures reported by other instances. Phases that
+// are closed can't be aborted anymore.
+func (p *Phases) Close() {
+	p.cancel()
+}
+
+// abort records the failure of a phase, unless one was already recorded.
+func (p *Phases) abort(e *PhaseAbortedError) {
+	p.mu.Lock()
+	if p.aborted != nil {
+		p.mu.Unlock()
+		return
+	}
+	p.aborted = e
+	p.mu.Unlock()
+
+	close(p.abortCh)
+	p.cancel()
+}
+
+// leave leaves the current phase, if it started, emitting its StageEndEvent
+// and recording its duration.
+func (p *Phases) leave(ctx context.Context) error {
+	p.mu.Lock()
+	phase, started := p.current, p.started
+	p.started = time.Time{}
+	p.mu.Unlock()
+
+	if started.IsZero() {
+		return nil
+	}
+
+	p.runenv.R().Timer(fmt.Sprintf("%s,phase=%s", PhaseDurationTimer, phase)).Update(time.Since(started))
+
+	return p.client.SignalEvent(ctx, &runtime.Event{StageEndEvent: &runtime.StageEndEvent{
+		Name:        string(phase),
+		TestGroupID: p.runenv.TestGroupID,
+	}})
+}
+
+// leaveFailed leaves the current phase once it failed, or was aborted. Errors
+// are logged, as the failure takes precedence.
+func (p *Phases) leaveFailed(ctx context.Context, phase Phase) {
+	if err := p.leave(ctx); err != nil {
+		p.runenv.SLogger().Warnw("failed to leave phase", "phase", phase, "error", err)
+	}
+}
+
+// context returns a child of the supplied context that is also cancelled when
+// the phases are aborted.
+func (p *Phases) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-p.abortCh:
+			cancel()
+		case <-stop:
+		}
+	}()
+	return ctx, func() {
+		close(stop)
+		cancel()
+	}
+}
@@ -0,0 +1,158 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/testground/sdk-go/runtime"
+)
+
+func TestPhasesLockstep(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	runenv, cleanup := runtime.RandomTestRunEnv(t)
+	t.Cleanup(cleanup)
+	runenv.TestInstanceCount = 2
+
+	hub := NewInmemHub()
+	a, b := hub.NewBoundClient(&runenv.RunParams), hub.NewBoundClient(&runenv.RunParams)
+	defer a.Close()
+	defer b.Close()
+
+	events, err := a.SubscribeEvents(ctx, &runenv.RunParams)
+	require.NoError(t, err)
+
+	phases := []Phase{"bootstrap", "connect", "teardown"}
+
+	// instance b lags behind in every phase; a must wait for it.
+	arrived := make(chan Phase, 16)
+	errs := make(chan error, 2)
+	for i, c := range []*InmemClient{a, b} {
+		p, err := NewPhases(ctx, c, runenv, phases...)
+		require.NoError(t, err)
+
+		lag := time.Duration(i) * 20 * time.Millisecond
+		go func(p *Phases) {
+			errs <- p.Run(ctx, func(ctx context.Context, phase Phase) error {
+				arrived <- phase
+				time.Sleep(lag)
+				return nil
+			})
+		}(p)
+	}
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+
+	close(arrived)
+	var order []Phase
+	for phase := range arrived {
+		order = append(order, phase)
+	}
+	require.Equal(t, []Phase{"bootstrap", "bootstrap", "connect", "connect", "teardown", "teardown"}, order)
+
+	var starts, ends int
+	for i := 0; i < 2*2*len(phases); i++ {
+		evt := <-events
+		switch {
+		case evt.StageStartEvent != nil:
+			starts++
+		case evt.StageEndEvent != nil:
+			ends++
+		}
+	}
+	require.Equal(t, 2*len(phases), starts)
+	require.Equal(t, 2*len(phases), ends)
+}
+
+func TestPhasesAbort(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	runenv, cleanup := runtime.RandomTestRunEnv(t)
+	t.Cleanup(cleanup)
+	runenv.TestInstanceCount = 2
+
+	hub := NewInmemHub()
+	a, b := hub.NewBoundClient(&runenv.RunParams), hub.NewBoundClient(&runenv.RunParams)
+	defer a.Close()
+	defer b.Close()
+
+	pa, err := NewPhases(ctx, a, runenv, "setup", "work")
+	require.NoError(t, err)
+	pb, err := NewPhases(ctx, b, runenv, "setup", "work")
+	require.NoError(t, err)
+
+	// phases are entered in order.
+	require.Error(t, pa.Enter(ctx, "work"))
+
+	boom := errors.New("boom")
+	errs := make(chan error, 2)
+	go func() {
+		errs <- pa.Run(ctx, func(ctx context.Context, phase Phase) error {
+			if phase == "work" {
+				return boom
+			}
+			return nil
+		})
+	}()
+	go func() {
+		errs <- pb.Run(ctx, func(ctx context.Context, phase Phase) error {
+			if phase == "work" {
+				// block until aborted.
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return nil
+		})
+	}()
+
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		if errors.Is(err, boom) {
+			continue
+		}
+		var aerr *PhaseAbortedError
+		require.True(t, errors.As(err, &aerr), err)
+		require.Equal(t, Phase("work"), aerr.Phase)
+		require.Equal(t, runenv.TestGroupID, aerr.GroupID)
+		require.Equal(t, "boom", aerr.Reason)
+	}
+
+	select {
+	case <-pb.Aborted():
+	default:
+		t.Fatal("expected phases to be aborted")
+	}
+
+	// the failed phase was left, and timed, nonetheless.
+	work := runenv.R().Timer(fmt.Sprintf("%s,phase=%s", PhaseDurationTimer, "work"))
+	require.GreaterOrEqual(t, work.Count(), int64(1))
+
+	// phases declared alike afterwards are aborted from the start.
+	pc, err := NewPhases(ctx, b, runenv, "setup", "work")
+	require.NoError(t, err)
+	defer pc.Close()
+	select {
+	case <-pc.Aborted():
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for abort")
+	}
+	require.Error(t, pc.Enter(ctx, "setup"))
+
+	// phases declared otherwise aren't, and don't share their states either.
+	for _, c := range []*InmemClient{a, b} {
+		p, err := NewPhases(ctx, c, runenv, "setup")
+		require.NoError(t, err)
+		require.NotEqual(t, pc.State("setup"), p.State("setup"))
+		go func(p *Phases) {
+			errs <- p.Run(ctx, func(context.Context, Phase) error { return nil })
+		}(p)
+	}
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+}
@@ -0,0 +1,396 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ElectLeader elects a leader among the instances that call it with the same
+// name and group: the first instance to signal entry on the election becomes
+// the leader. It returns whether this instance is the leader, along with its
+// rank in the election, starting at 1. Pass an empty group to hold the
+// election among all instances of the run.
+//
+// It is a replacement for hand-rolled "the instance with sequence number 1
+// leads" logic.
+func ElectLeader(ctx context.Context, client Client, name string, group string) (leader bool, seq int64, err error) {
+	state := State(fmt.Sprintf("election:%s:%s", name, group))
+	seq, err = client.SignalEntry(ctx, state)
+	if err != nil {
+		return false, -1, fmt.Errorf("failed while signalling entry to election %s: %w", name, err)
+	}
+	return seq == 1, seq, nil
+}
+
+// Semaphore is a distributed semaphore with a fixed number of permits, shared
+// by all the instances that construct it with the same name. Permits are
+// granted in the order they were requested.
+//
+// It is implemented as a log of acquisitions and releases on a Topic, which
+// every Semaphore follows once it is first used, to maintain the holders.
+// Close the Semaphore to stop following the log. Permits held by instances
+// that crash are never released.
+type Semaphore struct {
+	client  Client
+	topic   *Topic
+	permits int
+	view    *logView[semaphoreOp]
+
+	// guarded by view.mu.
+	holders map[int64]bool
+	queue   []int64
+}
+
+// Permit is a permit acquired from a Semaphore.
+type Permit struct {
+	sem *Semaphore
+	seq int64
+}
+
+type semaphoreOp struct {
+	Acquire bool `json:"acquire,omitempty"`
+	// Release is the sequence number of the acquisition being released.
+	Release int64 `json:"release,omitempty"`
+}
+
+// NewSemaphore constructs a Semaphore with the supplied number of permits.
+// All instances must agree on that number.
+func NewSemaphore(client Client, name string, permits int) *Semaphore {
+	s := &Semaphore{
+		client:  client,
+		topic:   NewTopic("semaphore:"+name, &semaphoreOp{}),
+		permits: permits,
+		holders: make(map[int64]bool),
+	}
+	s.view = newLogView(client, s.topic, s.apply)
+	return s
+}
+
+// NewMutex constructs a Semaphore with a single permit.
+func NewMutex(client Client, name string) *Semaphore {
+	return NewSemaphore(client, name, 1)
+}
+
+// apply applies an entry of the log to the holders.
+func (s *Semaphore) apply(i int64, op *semaphoreOp) {
+	switch {
+	case op.Acquire && len(s.holders) < s.permits:
+		s.holders[i] = true
+	case op.Acquire:
+		s.queue = append(s.queue, i)
+	case s.holders[op.Release]:
+		delete(s.holders, op.Release)
+		if len(s.queue) > 0 {
+			s.holders[s.queue[0]] = true
+			s.queue = s.queue[1:]
+		}
+	default:
+		// a waiter that gave up.
+		for j, q := range s.queue {
+			if q == op.Release {
+				s.queue = append(s.queue[:j], s.queue[j+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Acquire blocks until a permit is granted, or the context fires. If the
+// context fires, the pending request is withdrawn.
+func (s *Semaphore) Acquire(ctx context.Context) (*Permit, error) {
+	if s.permits < 1 {
+		return nil, fmt.Errorf("invalid number of permits: %d", s.permits)
+	}
+	if err := s.view.follow(ctx); err != nil {
+		return nil, err
+	}
+
+	seq, err := publishEntry(ctx, s.client, s.topic, &semaphoreOp{Acquire: true})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Permit{sem: s, seq: seq}
+	if err := s.view.waitFor(ctx, func() bool { return s.holders[seq] }); err != nil {
+		_ = p.Release(detach(ctx))
+		return nil, err
+	}
+	return p, nil
+}
+
+// MustAcquire calls Acquire, panicking if it errors.
+//
+// Suitable for shorthanding in test plans.
+func (s *Semaphore) MustAcquire(ctx context.Context) *Permit {
+	p, err := s.Acquire(ctx)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// Close stops following the log. Acquisitions fail from then on; permits
+// already acquired can still be released.
+func (s *Semaphore) Close() {
+	s.view.close()
+}
+
+// Release returns the permit to the Semaphore.
+func (p *Permit) Release(ctx context.Context) error {
+	_, err := publishEntry(ctx, p.sem.client, p.sem.topic, &semaphoreOp{Release: p.seq})
+	return err
+}
+
+// Counter is a distributed int64 counter, shared by all the instances that
+// construct it with the same name, supporting atomic additions and
+// compare-and-swap operations. Its initial value is zero.
+//
+// Like Semaphore, it is implemented as a log of operations on a Topic, which
+// every Counter follows once it is first used. Every operation, reads
+// included, appends to the log, and waits for the local view to reach it.
+// Close the Counter to stop following the log.
+type Counter struct {
+	client Client
+	topic  *Topic
+	view   *logView[counterOp]
+
+	// guarded by view.mu.
+	value    int64
+	inflight int                     // operations awaiting their result
+	results  map[int64]counterResult // recorded while operations are in flight
+}
+
+type counterOp struct {
+	Add int64 `json:"add,omitempty"`
+	CAS bool  `json:"cas,omitempty"`
+	Old int64 `json:"old,omitempty"`
+	New int64 `json:"new,omitempty"`
+}
+
+type counterResult struct {
+	value   int64
+	applied bool
+}
+
+// NewCounter constructs a Counter.
+func NewCounter(client Client, name string) *Counter {
+	c := &Counter{
+		client:  client,
+		topic:   NewTopic("counter:"+name, &counterOp{}),
+		results: make(map[int64]counterResult),
+	}
+	c.view = newLogView(client, c.topic, c.applyEntry)
+	return c
+}
+
+// Load returns the current value of the counter.
+func (c *Counter) Load(ctx context.Context) (int64, error) {
+	v, _, err := c.apply(ctx, &counterOp{})
+	return v, err
+}
+
+// Add adds delta to the counter, returning the new value.
+func (c *Counter) Add(ctx context.Context, delta int64) (int64, error) {
+	v, _, err := c.apply(ctx, &counterOp{Add: delta})
+	return v, err
+}
+
+// CompareAndSwap sets the counter to new if its value is old, returning
+// whether it did.
+func (c *Counter) CompareAndSwap(ctx context.Context, old, new int64) (swapped bool, err error) {
+	_, swapped, err = c.apply(ctx, &counterOp{CAS: true, Old: old, New: new})
+	return swapped, err
+}
+
+// Close stops following the log. Operations fail from then on.
+func (c *Counter) Close() {
+	c.view.close()
+}
+
+// applyEntry applies an entry of the log to the value, recording its result
+// if operations of this Counter are in flight.
+func (c *Counter) applyEntry(i int64, op *counterOp) {
+	applied := true
+	switch {
+	case !op.CAS:
+		c.value += op.Add
+	case c.value == op.Old:
+		c.value = op.New
+	default:
+		applied = false
+	}
+	if c.inflight > 0 {
+		c.results[i] = counterResult{c.value, applied}
+	}
+}
+
+// apply appends an operation to the log, and waits for the local view to
+// apply it, returning the resulting value, and whether the operation took
+// effect.
+func (c *Counter) apply(ctx context.Context, op *counterOp) (value int64, applied bool, err error) {
+	if err := c.view.follow(ctx); err != nil {
+		return 0, false, err
+	}
+
+	// record the results of the entries applied from now on, ours included.
+	c.view.mu.Lock()
+	c.inflight++
+	c.view.mu.Unlock()
+
+	seq := int64(-1)
+	defer func() {
+		c.view.mu.Lock()
+		defer c.view.mu.Unlock()
+		if c.inflight--; c.inflight == 0 {
+			c.results = make(map[int64]counterResult)
+		} else {
+			delete(c.results, seq)
+		}
+	}()
+
+	if seq, err = publishEntry(ctx, c.client, c.topic, op); err != nil {
+		return 0, false, err
+	}
+	if err := c.view.wait(ctx, seq); err != nil {
+		return 0, false, err
+	}
+
+	c.view.mu.Lock()
+	r := c.results[seq]
+	c.view.mu.Unlock()
+	return r.value, r.applied, nil
+}
+
+// logView maintains a local view of a log-structured topic: it follows the
+// topic, applying its entries in order, along with their sequence number, as
+// they arrive.
+type logView[T any] struct {
+	client Client
+	topic  *Topic
+	// apply is called with mu held.
+	apply func(seq int64, op *T)
+
+	mu      sync.Mutex
+	sub     *Subscription // nil until followed
+	applied int64         // sequence number of the last entry applied
+	err     error         // set once the log is no longer followed
+	// updated is closed, and replaced, whenever applied advances, or the
+	// log is no longer followed.
+	updated chan struct{}
+}
+
+func newLogView[T any](client Client, topic *Topic, apply func(seq int64, op *T)) *logView[T] {
+	return &logView[T]{client: client, topic: topic, apply: apply, updated: make(chan struct{})}
+}
+
+// follow starts following the log, if not yet. The subscription outlives the
+// supplied context; see close.
+func (v *logView[T]) follow(ctx context.Context) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.sub != nil {
+		return nil
+	}
+
+	// entries that can't be decoded would throw off the sequence numbers.
+	ch := make(chan *T, 64)
+	sub, err := v.client.Subscribe(detach(ctx), v.topic, ch, FailOnDecodeError(), CloseOnDone())
+	if err != nil {
+		return err
+	}
+	v.sub = sub
+
+	go func() {
+		var (
+			seq  int64
+			last *T
+		)
+		for op := range ch {
+			// every entry is decoded anew, so a duplicate delivery, as made
+			// by a ChaosInterceptor, is the same pointer as the last one.
+			if op == last {
+				continue
+			}
+			last = op
+			seq++
+
+			v.mu.Lock()
+			v.apply(seq, op)
+			v.applied = seq
+			close(v.updated)
+			v.updated = make(chan struct{})
+			v.mu.Unlock()
+		}
+
+		// the subscription ended; fail the waiters.
+		err := sub.Err()
+		if err == nil {
+			err = errors.New("subscription closed")
+		}
+
+		v.mu.Lock()
+		v.err = fmt.Errorf("topic %s no longer followed: %w", v.topic.name, err)
+		close(v.updated)
+		v.updated = make(chan struct{})
+		v.mu.Unlock()
+	}()
+	return nil
+}
+
+// waitFor waits until cond, called with mu held, holds, following the log if
+// not yet. It fails once the log is no longer followed, as the view may be
+// stale from then on.
+func (v *logView[T]) waitFor(ctx context.Context, cond func() bool) error {
+	if err := v.follow(ctx); err != nil {
+		return err
+	}
+
+	for {
+		v.mu.Lock()
+		ok, err, updated := cond(), v.err, v.updated
+		v.mu.Unlock()
+
+		switch {
+		case err != nil:
+			return err
+		case ok:
+			return nil
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// wait waits until the entry with the supplied sequence number has been
+// applied.
+func (v *logView[T]) wait(ctx context.Context, seq int64) error {
+	return v.waitFor(ctx, func() bool { return v.applied >= seq })
+}
+
+// close stops following the log.
+func (v *logView[T]) close() {
+	v.mu.Lock()
+	sub := v.sub
+	v.mu.Unlock()
+
+	if sub != nil {
+		sub.Cancel()
+	}
+}
+
+// publishEntry publishes an entry to a log, failing with ErrPublishDropped if
+// it was dropped, as the callers wait for it to show up.
+func publishEntry(ctx context.Context, client Client, topic *Topic, payload interface{}) (int64, error) {
+	seq, err := client.Publish(ctx, topic, payload)
+	if err == nil && seq == ChaosDroppedSeq {
+		return -1, fmt.Errorf("failed to publish to topic %s: %w", topic.name, ErrPublishDropped)
+	}
+	return seq, err
+}
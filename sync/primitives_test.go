@@ -0,0 +1,159 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/testground/sdk-go/runtime"
+)
+
+func newInmemInstances(n int) []*InmemClient {
+	hub := NewInmemHub()
+	rp := &runtime.RunParams{TestRun: "run"}
+	clients := make([]*InmemClient, n)
+	for i := range clients {
+		clients[i] = hub.NewBoundClient(rp)
+	}
+	return clients
+}
+
+func TestElectLeader(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clients := newInmemInstances(3)
+
+	leaders := 0
+	for _, c := range clients {
+		leader, _, err := ElectLeader(ctx, c, "coordinator", "a")
+		require.NoError(t, err)
+		if leader {
+			leaders++
+		}
+	}
+	require.Equal(t, 1, leaders)
+
+	// elections in other groups are independent.
+	leader, seq, err := ElectLeader(ctx, clients[0], "coordinator", "b")
+	require.NoError(t, err)
+	require.True(t, leader)
+	require.EqualValues(t, 1, seq)
+}
+
+func TestSemaphore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clients := newInmemInstances(4)
+
+	var permits []*Permit
+	for _, c := range clients[:2] {
+		permits = append(permits, NewSemaphore(c, "sem", 2).MustAcquire(ctx))
+	}
+
+	// the semaphore is exhausted; a waiter that gives up is withdrawn.
+	tctx, tcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	_, err := NewSemaphore(clients[2], "sem", 2).Acquire(tctx)
+	tcancel()
+	require.Error(t, err)
+
+	acquired := make(chan *Permit)
+	go func() {
+		acquired <- NewSemaphore(clients[3], "sem", 2).MustAcquire(ctx)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("acquired a permit while the semaphore was exhausted")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, permits[0].Release(ctx))
+	select {
+	case p := <-acquired:
+		require.NoError(t, p.Release(ctx))
+	case <-ctx.Done():
+		t.Fatal("permit not granted after release")
+	}
+}
+
+func TestCounter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clients := newInmemInstances(2)
+	a, b := NewCounter(clients[0], "c"), NewCounter(clients[1], "c")
+
+	v, err := a.Add(ctx, 5)
+	require.NoError(t, err)
+	require.EqualValues(t, 5, v)
+
+	swapped, err := b.CompareAndSwap(ctx, 5, 7)
+	require.NoError(t, err)
+	require.True(t, swapped)
+
+	swapped, err = a.CompareAndSwap(ctx, 5, 9)
+	require.NoError(t, err)
+	require.False(t, swapped)
+
+	v, err = a.Load(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 7, v)
+
+	// operations are applied to a followed view, rather than replaying the
+	// log every time.
+	for i := 0; i < 10; i++ {
+		_, err = a.Add(ctx, 1)
+		require.NoError(t, err)
+	}
+	require.Len(t, clients[0].Subscriptions(), 1)
+
+	a.Close()
+	_, err = a.Load(ctx)
+	require.Error(t, err)
+	v, err = b.Load(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 17, v)
+}
+
+func TestPrimitivesChaos(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clients := newInmemInstances(2)
+	chaotic := make([]Client, len(clients))
+	for i, c := range clients {
+		chaotic[i] = WithInterceptors(c, ChaosInterceptor(Chaos{DuplicateRate: 0.5, Seed: int64(i)}))
+	}
+
+	// duplicate deliveries don't throw off the sequence numbers.
+	a, b := NewCounter(chaotic[0], "c"), NewCounter(chaotic[1], "c")
+	for i := 0; i < 10; i++ {
+		_, err := a.Add(ctx, 1)
+		require.NoError(t, err)
+		swapped, err := b.CompareAndSwap(ctx, int64(2*i+1), int64(2*i+2))
+		require.NoError(t, err)
+		require.True(t, swapped)
+	}
+	v, err := a.Load(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 20, v)
+
+	mutexes := []*Semaphore{NewMutex(chaotic[0], "m"), NewMutex(chaotic[1], "m")}
+	for i := 0; i < 10; i++ {
+		p, err := mutexes[i%2].Acquire(ctx)
+		require.NoError(t, err)
+		require.NoError(t, p.Release(ctx))
+	}
+
+	// dropped entries fail the operations, rather than waiting forever.
+	dropping := WithInterceptors(clients[0], ChaosInterceptor(Chaos{PublishDropRate: 1}))
+	_, err = NewCounter(dropping, "c").Add(ctx, 1)
+	require.True(t, errors.Is(err, ErrPublishDropped))
+	_, err = NewMutex(dropping, "m").Acquire(ctx)
+	require.True(t, errors.Is(err, ErrPublishDropped))
+	require.NoError(t, ctx.Err())
+}
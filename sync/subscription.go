@@ -0,0 +1,649 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/testground/sdk-go/runtime"
+	"go.uber.org/zap"
+)
+
+// DecodeErrorsCounter is the name of the diagnostics counter, in RunEnv.D(),
+// where bound clients count the topic entries that failed to decode, unless
+// the subscription specifies a counter of its own.
+const DecodeErrorsCounter = "sync.subscribe.decode_errors"
+
+// DroppedEntriesCounter is the name of the diagnostics counter, in RunEnv.D(),
+// where bound clients count the topic entries dropped by subscriptions whose
+// buffer overflowed. See WithBuffer.
+const DroppedEntriesCounter = "sync.subscribe.dropped_entries"
+
+// ErrSubscriptionOverflow is reported through Subscription.Done() when the
+// buffer of a subscription with the OverflowError policy overflows.
+var ErrSubscriptionOverflow = errors.New("subscription buffer overflowed")
+
+// ErrSubscriptionCancelled is returned by Subscription.Err when the
+// subscription was terminated through Subscription.Cancel.
+var ErrSubscriptionCancelled = errors.New("subscription cancelled")
+
+// SubscriptionBuffer is the default number of entries buffered by a
+// subscription while the subscriber is not consuming them. See WithBuffer.
+var SubscriptionBuffer = 1024
+
+// SubscribeOption configures a subscription. See Client.Subscribe.
+type SubscribeOption func(*subscribeOptions)
+
+// OverflowPolicy determines what a subscription does with the entries it
+// receives while its buffer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock stops receiving entries until the subscriber catches up.
+	// With the DefaultClient, this holds up the responses to every other
+	// request on the connection, barriers included, so it is only suitable
+	// for subscribers that are known to keep up.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest evicts the oldest buffered entry to make room.
+	OverflowDropOldest
+	// OverflowDropNewest discards the entry received.
+	OverflowDropNewest
+	// OverflowError terminates the subscription with ErrSubscriptionOverflow.
+	// It is the default, as it neither stalls the client nor loses entries
+	// silently.
+	OverflowError
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowError:
+		return "error"
+	default:
+		return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+	}
+}
+
+// ErrTailUnsupported is returned by the DefaultClient when subscribing with
+// LiveOnly or ReplayLast. The sync service can't tell how many entries a topic
+// holds, so the existing entries can't be told apart from the new ones.
+var ErrTailUnsupported = errors.New("LiveOnly and ReplayLast are not supported by the sync service")
+
+type subscribeOptions struct {
+	failOnDecodeError bool
+	deadLetters       chan<- *DecodeError
+	decodeErrors      runtime.Counter
+
+	// startAt is the sequence number of the first entry to deliver.
+	startAt int64
+	// tail is set if only the last entries of the backlog must be
+	// delivered, followed by all live entries.
+	tail bool
+	last int
+
+	bufferSize int
+	overflow   OverflowPolicy
+	dropped    runtime.Counter
+
+	closeOnDone bool
+}
+
+// CloseOnDone closes the subscription channel when the subscription
+// terminates, after the last entry has been delivered, so that the subscriber
+// can range over it. Subscription.Err tells why the subscription terminated.
+func CloseOnDone() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.closeOnDone = true
+	}
+}
+
+// WithBuffer buffers up to size entries that the subscriber has yet to
+// consume, instead of SubscriptionBuffer, and applies the supplied policy when
+// the buffer is full, instead of OverflowError. Dropped entries are counted in
+// DroppedEntriesCounter.
+func WithBuffer(size int, policy OverflowPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.bufferSize = size
+		o.overflow = policy
+	}
+}
+
+// StartAt delivers the entries whose sequence number is equal or greater than
+// seq, skipping the previous ones. Sequence numbers start at 1, and are those
+// returned by Publish.
+//
+// The sync service always replays a topic from its first entry, so the
+// DefaultClient still receives the skipped entries; it only spares decoding
+// and delivering them.
+func StartAt(seq int64) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.startAt = seq
+	}
+}
+
+// LiveOnly only delivers the entries published after subscribing, skipping
+// the existing ones. It is equivalent to ReplayLast(0).
+func LiveOnly() SubscribeOption {
+	return ReplayLast(0)
+}
+
+// ReplayLast only delivers the last n of the existing entries, followed by
+// all the entries published after subscribing.
+//
+// It is supported by the in-memory client only; the DefaultClient fails with
+// ErrTailUnsupported. With the sync service, use StartAt with a sequence
+// number returned by Publish instead.
+//
+// Entries skipped by StartAt don't count towards the n replayed ones.
+func ReplayLast(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.tail = true
+		o.last = n
+	}
+}
+
+// FailOnDecodeError terminates the subscription as soon as an entry fails to
+// decode. The *DecodeError is reported through Subscription.Done().
+func FailOnDecodeError() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.failOnDecodeError = true
+	}
+}
+
+// WithDeadLetters delivers the entries that fail to decode to the supplied
+// channel, instead of skipping them. The channel is subject to the same
+// backpressure rules as the subscription channel.
+func WithDeadLetters(ch chan<- *DecodeError) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.deadLetters = ch
+	}
+}
+
+// WithDecodeErrorCounter counts the entries that fail to decode in the
+// supplied counter, e.g. one obtained through RunEnv.D().Counter.
+func WithDecodeErrorCounter(counter runtime.Counter) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.decodeErrors = counter
+	}
+}
+
+// DecodeError describes a topic entry that could not be decoded into the type
+// of the Topic, e.g. because the publisher is running a different version of
+// the test plan, or used a different Codec.
+type DecodeError struct {
+	// Key is the key of the topic.
+	Key string
+	// Seq is the sequence number of the entry within the topic.
+	Seq int64
+	// Raw is the entry as received from the sync service.
+	Raw string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode entry %d of topic %s: %s", e.Seq, e.Key, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// sink delivers decoded topic entries to a subscriber-supplied channel,
+// performing the necessary pointer to value conversions, and applying the
+// subscription options.
+//
+// Entries are handed to the sink through push, and delivered by run, on
+// separate goroutines, so that a slow subscriber does not hold up the
+// reception of entries beyond what the overflow policy dictates.
+type sink struct {
+	key   string
+	ch    reflect.Value
+	deref bool
+	val   *typeValidator
+	opts  subscribeOptions
+	log   *zap.SugaredLogger
+
+	// delivered, if set, is called with the time each entry spent in the
+	// buffer, once delivered.
+	delivered func(lag time.Duration)
+
+	mu      sync.Mutex
+	pending []pendingEntry
+	closed  bool  // no more entries will be pushed.
+	err     error // the error to terminate the subscription with.
+	abort   context.CancelFunc
+	wake    chan struct{}
+	space   chan struct{}
+	ended   chan struct{}
+}
+
+type pendingEntry struct {
+	seq int64
+	raw string
+	at  time.Time
+}
+
+// newSink validates that ch is a channel whose element type is a value or
+// pointer type matching the type accepted by the validator.
+func newSink(key string, val *typeValidator, ch interface{}, opts ...SubscribeOption) (*sink, error) {
+	chv := reflect.ValueOf(ch)
+	if k := chv.Kind(); k != reflect.Chan {
+		return nil, fmt.Errorf("value is not a channel: %T", ch)
+	}
+
+	// compare the naked types; this makes the subscription work with pointer
+	// or value channels.
+	var deref bool
+	chtyp := chv.Type().Elem()
+	if chtyp.Kind() == reflect.Ptr {
+		chtyp = chtyp.Elem()
+	} else {
+		deref = true
+	}
+
+	typ := val.typ
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if chtyp != typ {
+		return nil, fmt.Errorf("invalid channel type; expected: chan [*]%s, was: %T", typ, ch)
+	}
+
+	s := &sink{
+		key:   key,
+		ch:    chv,
+		deref: deref,
+		val:   val,
+		log:   zap.S(),
+		wake:  make(chan struct{}, 1),
+		space: make(chan struct{}, 1),
+		ended: make(chan struct{}),
+	}
+	s.opts.bufferSize = SubscriptionBuffer
+	s.opts.overflow = OverflowError
+	for _, opt := range opts {
+		opt(&s.opts)
+	}
+	if s.opts.last < 0 {
+		return nil, fmt.Errorf("invalid number of entries to replay: %d", s.opts.last)
+	}
+	if s.opts.bufferSize < 1 {
+		return nil, fmt.Errorf("invalid subscription buffer size: %d", s.opts.bufferSize)
+	}
+	if s.opts.overflow < OverflowBlock || s.opts.overflow > OverflowError {
+		return nil, fmt.Errorf("invalid overflow policy: %s", s.opts.overflow)
+	}
+	return s, nil
+}
+
+// subscription creates the Subscription served by this sink, which is
+// cancelled by calling cancel.
+func (s *sink) subscription(cancel context.CancelFunc) *Subscription {
+	sub := newSubscription(s.key, cancel)
+	if s.opts.closeOnDone {
+		sub.ch = s.ch
+	}
+	return sub
+}
+
+// signal performs a non-blocking notification on a channel with capacity 1.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// push buffers a raw entry for delivery, applying the overflow policy if the
+// buffer is full. It returns false if the subscription is terminating, in
+// which case no more entries must be pushed.
+func (s *sink) push(ctx context.Context, seq int64, raw string) bool {
+	if seq < s.opts.startAt {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for !s.closed && len(s.pending) >= s.opts.bufferSize {
+		switch s.opts.overflow {
+		case OverflowDropOldest:
+			s.drop(s.pending[0].seq)
+			s.pending = s.pending[1:]
+		case OverflowDropNewest:
+			s.drop(seq)
+			return true
+		case OverflowError:
+			s.fail(ErrSubscriptionOverflow)
+			return false
+		default:
+			s.mu.Unlock()
+			select {
+			case <-s.space:
+			case <-s.ended:
+			case <-ctx.Done():
+			}
+			s.mu.Lock()
+			if ctx.Err() != nil {
+				return false
+			}
+		}
+	}
+	if s.closed {
+		return false
+	}
+
+	s.pending = append(s.pending, pendingEntry{seq, raw, time.Now()})
+	signal(s.wake)
+	return true
+}
+
+// drop accounts for an entry dropped due to an overflow. It must be called
+// with mu held.
+func (s *sink) drop(seq int64) {
+	if s.opts.dropped != nil {
+		s.opts.dropped.Inc(1)
+	}
+	s.log.Debugw("subscription buffer full; dropped entry", "key", s.key, "seq", seq, "policy", s.opts.overflow)
+}
+
+// fail terminates the subscription with the supplied error, discarding the
+// buffered entries, and aborting the ongoing delivery. It must be called with
+// mu held.
+func (s *sink) fail(err error) {
+	s.closed, s.err, s.pending = true, err, nil
+	if s.abort != nil {
+		s.abort()
+	}
+	signal(s.wake)
+}
+
+// close signals that no more entries will be pushed. The subscription
+// terminates with the supplied error once the buffered entries have been
+// delivered.
+func (s *sink) close(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed, s.err = true, err
+		signal(s.wake)
+	}
+}
+
+// failure returns the error the subscription was terminated with, if any.
+// The context of run is cancelled when the subscription is terminated through
+// fail.
+func (s *sink) failure() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// done returns a channel that is closed when run returns.
+func (s *sink) done() <-chan struct{} {
+	return s.ended
+}
+
+// run delivers the buffered entries until the sink is closed and drained, the
+// context fires, or a delivery fails, and returns the error the subscription
+// terminates with.
+func (s *sink) run(ctx context.Context) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	s.mu.Lock()
+	s.abort = cancel
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.closed, s.pending = true, nil
+		s.mu.Unlock()
+		cancel()
+		close(s.ended)
+	}()
+
+	for {
+		s.mu.Lock()
+		if len(s.pending) == 0 {
+			closed, err := s.closed, s.err
+			s.mu.Unlock()
+			if closed {
+				return err
+			}
+			select {
+			case <-s.wake:
+				continue
+			case <-ctx.Done():
+				return s.failure()
+			}
+		}
+		e := s.pending[0]
+		s.pending = s.pending[1:]
+		signal(s.space)
+		s.mu.Unlock()
+
+		ok, err := s.deliver(ctx, e.seq, e.raw)
+		if !ok {
+			if err == nil {
+				err = s.failure()
+			}
+			return err
+		}
+		if s.delivered != nil {
+			s.delivered(time.Since(e.at))
+		}
+	}
+}
+
+// deliver decodes a raw entry, and sends it to the channel, handling decoding
+// errors as configured.
+//
+// It returns false if the subscription must terminate, along with the error to
+// report; the error is nil if the context fired.
+func (s *sink) deliver(ctx context.Context, seq int64, raw string) (ok bool, err error) {
+	if seq < s.opts.startAt {
+		return true, nil
+	}
+
+	v, err := s.val.decodePayload(raw)
+	if err != nil {
+		derr := &DecodeError{Key: s.key, Seq: seq, Raw: raw, Err: err}
+		if s.opts.decodeErrors != nil {
+			s.opts.decodeErrors.Inc(1)
+		}
+
+		switch {
+		case s.opts.failOnDecodeError:
+			return false, derr
+		case s.opts.deadLetters != nil:
+			select {
+			case s.opts.deadLetters <- derr:
+				return true, nil
+			case <-ctx.Done():
+				return false, nil
+			}
+		default:
+			s.log.Warnw("skipping topic entry that failed to decode", "key", s.key, "seq", seq, "error", err)
+			return true, nil
+		}
+	}
+
+	return s.send(ctx, v), nil
+}
+
+// send sends a value decoded by decodePayload into the channel.
+//
+// send will block if the receiver is not consuming from the channel. If the
+// context is closed, the send will be aborted, and false will be returned.
+func (s *sink) send(ctx context.Context, v reflect.Value) (sent bool) {
+	if s.deref {
+		v = v.Elem()
+	}
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectSend, Chan: s.ch, Send: v},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+	}
+	chosen, _, _ := reflect.Select(cases)
+	return chosen == 0
+}
+
+// interpose subscribes through subscribe with a channel of the same type as
+// ch, and calls forward with every entry received on it, along with a function
+// that sends a value to ch. The function returns false if the context fired,
+// after which forward is not called again. If set, end is called with the
+// error the subscription ended with, right before it is reported through the
+// returned Subscription.
+//
+// Cancelling the returned Subscription cancels the context passed to
+// subscribe. If the channel passed to subscribe is closed on termination, so
+// is ch.
+//
+// If ch is not a channel, it is passed to subscribe as is, to be rejected.
+func interpose(ctx context.Context, ch interface{}, subscribe func(ctx context.Context, inner interface{}) (*Subscription, error), forward func(v reflect.Value, send func(reflect.Value) bool), end func(err error)) (*Subscription, error) {
+	chv := reflect.ValueOf(ch)
+	if chv.Kind() != reflect.Chan {
+		return subscribe(ctx, ch)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	inner := reflect.MakeChan(chv.Type(), chv.Cap())
+	sub, err := subscribe(ctx, inner.Interface())
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	out := newSubscription(sub.Topic(), cancel)
+	go func() {
+		recv := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: inner},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(sub.Done())},
+		}
+		send := func(v reflect.Value) bool {
+			cases := []reflect.SelectCase{
+				{Dir: reflect.SelectSend, Chan: chv, Send: v},
+				{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+			}
+			if chosen, _, _ := reflect.Select(cases); chosen == 1 {
+				// the context fired; wait for the subscription to end.
+				recv[0].Chan = reflect.Value{}
+				return false
+			}
+			return true
+		}
+
+		var closed bool
+		for {
+			chosen, v, ok := reflect.Select(recv)
+			switch {
+			case chosen == 0 && !ok:
+				closed = true
+				recv[0].Chan = reflect.Value{}
+				continue
+			case chosen == 0:
+				forward(v, send)
+				continue
+			}
+
+			// the entries still in the channel were sent before the
+			// subscription ended.
+			for recv[0].Chan.IsValid() {
+				e, ok := inner.TryRecv()
+				switch {
+				case ok:
+					forward(e, send)
+				case e.IsValid():
+					// a zero value is received from a closed channel.
+					closed = true
+					recv[0].Chan = reflect.Value{}
+				default:
+					recv[0].Chan = reflect.Value{}
+				}
+			}
+
+			var err error
+			if !v.IsNil() {
+				err = v.Interface().(error)
+			}
+			if end != nil {
+				end(err)
+			}
+			if closed {
+				out.ch = chv
+			}
+			out.finish(err, sub.Err())
+			return
+		}
+	}()
+
+	return out, nil
+}
+
+// subscriptionSet tracks the active subscriptions of a client. The zero value
+// is ready to use.
+type subscriptionSet struct {
+	mu sync.Mutex
+	m  map[*Subscription]time.Time
+}
+
+// add tracks a subscription until it terminates. It is a no-op if the
+// subscription has terminated already.
+func (ss *subscriptionSet) add(sub *Subscription) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.ended {
+		return
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.m == nil {
+		ss.m = make(map[*Subscription]time.Time)
+	}
+	ss.m[sub] = time.Now()
+	sub.release = func() {
+		ss.mu.Lock()
+		delete(ss.m, sub)
+		ss.mu.Unlock()
+	}
+}
+
+// list returns the active subscriptions, oldest first.
+func (ss *subscriptionSet) list() []*Subscription {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	subs := make([]*Subscription, 0, len(ss.m))
+	for sub := range ss.m {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		return ss.m[subs[i]].Before(ss.m[subs[j]])
+	})
+	return subs
+}
+
+// warnActive logs the subscriptions that are still active when the client is
+// closed, as they are likely to have been leaked.
+func (ss *subscriptionSet) warnActive(log *zap.SugaredLogger) {
+	subs := ss.list()
+	if len(subs) == 0 {
+		return
+	}
+	topics := make([]string, 0, len(subs))
+	for _, sub := range subs {
+		topics = append(topics, sub.Topic())
+	}
+	log.Warnw("closing sync client with active subscriptions; they will be cancelled", "count", len(subs), "topics", topics)
+}
@@ -0,0 +1,194 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/require"
+	"github.com/testground/sdk-go/runtime"
+)
+
+func TestSubscriptionDecodeErrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := NewInmemHub().NewBoundClient(&runtime.RunParams{TestRun: "run"})
+	defer client.Close()
+
+	// the second entry is published by an instance that disagrees on the
+	// payload type of the topic.
+	type record struct{ N int }
+	client.MustPublish(ctx, NewTopic("records", &record{}), &record{1})
+	client.MustPublish(ctx, NewTopic("records", ""), "garbage")
+	client.MustPublish(ctx, NewTopic("records", &record{}), &record{3})
+
+	topic := NewTopic("records", &record{})
+
+	t.Run("skip", func(t *testing.T) {
+		counter := metrics.NewCounter()
+		ch := make(chan *record, 2)
+		client.MustSubscribe(ctx, topic, ch, WithDecodeErrorCounter(counter))
+
+		require.Equal(t, 1, (<-ch).N)
+		require.Equal(t, 3, (<-ch).N)
+		require.EqualValues(t, 1, counter.Count())
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		ch := make(chan *record, 2)
+		sub := client.MustSubscribe(ctx, topic, ch, FailOnDecodeError())
+
+		require.Equal(t, 1, (<-ch).N)
+
+		var derr *DecodeError
+		err := <-sub.Done()
+		require.True(t, errors.As(err, &derr), err)
+		require.EqualValues(t, 2, derr.Seq)
+		require.Equal(t, `"garbage"`, derr.Raw)
+		require.Empty(t, ch)
+	})
+
+	t.Run("dead letters", func(t *testing.T) {
+		ch := make(chan *record, 2)
+		dead := make(chan *DecodeError, 1)
+		client.MustSubscribe(ctx, topic, ch, WithDeadLetters(dead))
+
+		require.Equal(t, 1, (<-ch).N)
+		require.Equal(t, 3, (<-ch).N)
+		require.EqualValues(t, 2, (<-dead).Seq)
+	})
+}
+
+func TestSubscribeOptions(t *testing.T) {
+	forEachClient(t, func(t *testing.T, client Client) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		topic := NewTopic("options", 0)
+		for n := 1; n <= 5; n++ {
+			client.MustPublish(ctx, topic, n)
+		}
+
+		from := make(chan int, 16)
+		client.MustSubscribe(ctx, topic, from, StartAt(4))
+		require.Equal(t, 4, <-from)
+		require.Equal(t, 5, <-from)
+
+		// the sync service can't tell existing entries from new ones.
+		if _, ok := client.(*DefaultClient); ok {
+			_, err := client.Subscribe(ctx, topic, make(chan int), LiveOnly())
+			require.True(t, errors.Is(err, ErrTailUnsupported), err)
+			_, err = client.Subscribe(ctx, topic, make(chan int), ReplayLast(2))
+			require.True(t, errors.Is(err, ErrTailUnsupported), err)
+			return
+		}
+
+		live := make(chan int, 16)
+		client.MustSubscribe(ctx, topic, live, LiveOnly())
+		last := make(chan int, 16)
+		client.MustSubscribe(ctx, topic, last, ReplayLast(2))
+		require.Equal(t, 4, <-last)
+		require.Equal(t, 5, <-last)
+
+		client.MustPublish(ctx, topic, 6)
+		require.Equal(t, 6, <-from)
+		require.Equal(t, 6, <-live)
+		require.Equal(t, 6, <-last)
+	})
+}
+
+func TestSubscriptionOverflow(t *testing.T) {
+	forEachClient(t, func(t *testing.T, client Client) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		topic := NewTopic("overflow", 0)
+		for n := 1; n <= 5; n++ {
+			client.MustPublish(ctx, topic, n)
+		}
+
+		// subscribe without consuming, and give the entries time to arrive.
+		subscribe := func(policy OverflowPolicy) (chan int, *Subscription) {
+			ch := make(chan int)
+			sub := client.MustSubscribe(ctx, topic, ch, WithBuffer(2, policy))
+			return ch, sub
+		}
+		collect := func(ch chan int) (got []int) {
+			for {
+				select {
+				case n := <-ch:
+					got = append(got, n)
+				case <-time.After(500 * time.Millisecond):
+					return got
+				}
+			}
+		}
+
+		oldest, _ := subscribe(OverflowDropOldest)
+		newest, _ := subscribe(OverflowDropNewest)
+		blocking, _ := subscribe(OverflowBlock)
+		_, failing := subscribe(OverflowError)
+		time.Sleep(500 * time.Millisecond)
+
+		got := collect(oldest)
+		require.Less(t, len(got), 5)
+		require.Equal(t, 5, got[len(got)-1])
+
+		got = collect(newest)
+		require.Less(t, len(got), 5)
+		require.Equal(t, 1, got[0])
+
+		require.Equal(t, []int{1, 2, 3, 4, 5}, collect(blocking))
+
+		require.True(t, errors.Is(<-failing.Done(), ErrSubscriptionOverflow))
+	})
+
+	_, err := newSink("key", NewTopic("t", 0).typeValidator, make(chan int), WithBuffer(0, OverflowBlock))
+	require.Error(t, err)
+
+	// overflowing subscriptions fail by default, rather than stalling.
+	s, err := newSink("key", NewTopic("t", 0).typeValidator, make(chan int))
+	require.NoError(t, err)
+	require.Equal(t, OverflowError, s.opts.overflow)
+}
+
+func TestSubscriptionLifecycle(t *testing.T) {
+	forEachClient(t, func(t *testing.T, client Client) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		topic := NewTopic("lifecycle", 0)
+		client.MustPublish(ctx, topic, 1)
+
+		ch := make(chan int, 4)
+		sub := client.MustSubscribe(ctx, topic, ch, CloseOnDone())
+		require.Equal(t, 1, <-ch)
+		require.Contains(t, client.Subscriptions(), sub)
+		require.NoError(t, sub.Err())
+
+		sub.Cancel()
+		for range ch {
+		}
+		require.NoError(t, <-sub.Done())
+		require.True(t, errors.Is(sub.Err(), ErrSubscriptionCancelled), sub.Err())
+		require.NotContains(t, client.Subscriptions(), sub)
+		sub.Cancel()
+
+		// the reason is preserved through decorators.
+		subctx, subcancel := context.WithCancel(ctx)
+		decorated := WithInterceptors(client, ChaosInterceptor(Chaos{DuplicateRate: 1}))
+		ch = make(chan int, 4)
+		sub = decorated.MustSubscribe(subctx, topic, ch, CloseOnDone())
+		require.Equal(t, 1, <-ch)
+		require.Equal(t, 1, <-ch)
+
+		subcancel()
+		for range ch {
+		}
+		require.NoError(t, <-sub.Done())
+		require.True(t, errors.Is(sub.Err(), context.Canceled), sub.Err())
+	})
+}
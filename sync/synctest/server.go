@@ -0,0 +1,500 @@
+// Package synctest provides an in-process stand-in for the Testground sync
+// service, speaking the same websocket protocol, so that code using
+// sync.DefaultClient can be tested end-to-end without a running sync service.
+//
+// Typical usage:
+//
+//   srv := synctest.NewServer()
+//   defer srv.Close()
+//
+//   os.Setenv(sync.EnvServiceHost, srv.Host())
+//   os.Setenv(sync.EnvServicePort, srv.Port())
+//   client := sync.MustBoundClient(ctx, runenv)
+//
+// The server can also be reached over TLS (see NewTLSServer), and over the TCP
+// transport of the sync package (see ServeTCP).
+package synctest
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	tgsync "github.com/testground/sync-service"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// Server is an in-process sync service, backed by an httptest.Server. All
+// data is held in memory, and lives for as long as the Server does.
+type Server struct {
+	*httptest.Server
+
+	// AuthToken, if set, is the bearer token that websocket clients must
+	// present in their Authorization header.
+	AuthToken string
+
+	mu     sync.Mutex
+	topics map[string]*topic
+	states map[string]*state
+	conns  map[*conn]struct{}
+	tcp    net.Listener
+	ids    []string
+}
+
+type topic struct {
+	entries []string
+
+	// notify is closed, and replaced, whenever an entry is appended.
+	notify chan struct{}
+}
+
+type state struct {
+	count int
+
+	// notify is closed, and replaced, whenever the counter is incremented.
+	notify chan struct{}
+}
+
+// NewServer starts and returns a new Server. The caller should call Close
+// when finished, to shut it down.
+func NewServer() *Server {
+	s := &Server{
+		topics: make(map[string]*topic),
+		states: make(map[string]*state),
+		conns:  make(map[*conn]struct{}),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// NewTLSServer starts and returns a new Server that is reached through wss://
+// addresses. Clients must trust its certificate; see ClientTLSConfig.
+func NewTLSServer() *Server {
+	s := &Server{
+		topics: make(map[string]*topic),
+		states: make(map[string]*state),
+		conns:  make(map[*conn]struct{}),
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Addr returns the websocket address of the server, as a ws:// or wss:// URL.
+func (s *Server) Addr() string {
+	if s.TLS != nil {
+		return "wss://" + s.Listener.Addr().String()
+	}
+	return "ws://" + s.Listener.Addr().String()
+}
+
+// ClientTLSConfig returns a TLS configuration that trusts the certificate of a
+// server started with NewTLSServer.
+func (s *Server) ClientTLSConfig() *tls.Config {
+	return s.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+}
+
+// ServeTCP starts serving the TCP transport of the sync package, with
+// length-prefixed JSON frames, and returns its tcp:// address. The listener
+// shares the data of the websocket server, and is closed along with it.
+func (s *Server) ServeTCP() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tcp == nil {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return "", err
+		}
+		s.tcp = l
+		go s.acceptTCP(l)
+	}
+	return "tcp://" + s.tcp.Addr().String(), nil
+}
+
+func (s *Server) acceptTCP(l net.Listener) {
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(&tcpWire{conn: nc, r: bufio.NewReader(nc)})
+	}
+}
+
+// Host returns the host the server is listening on, suitable for the
+// SYNC_SERVICE_HOST environment variable.
+func (s *Server) Host() string {
+	host, _, _ := net.SplitHostPort(s.Listener.Addr().String())
+	return host
+}
+
+// Port returns the port the server is listening on, suitable for the
+// SYNC_SERVICE_PORT environment variable.
+func (s *Server) Port() string {
+	_, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	return port
+}
+
+// DropConnections abruptly terminates all established client connections,
+// simulating a network blip. Data held by the server is retained.
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	conns := make([]*conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.cancel()
+		c.wire.close(false)
+	}
+}
+
+// Close drops all client connections, and shuts down the server.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.tcp != nil {
+		_ = s.tcp.Close()
+	}
+	s.mu.Unlock()
+
+	s.DropConnections()
+	s.Server.Close()
+}
+
+// Entries returns the JSON-encoded entries published on a topic key so far.
+func (s *Server) Entries(key string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.topic(key).entries...)
+}
+
+// RequestIDs returns the IDs of the requests received so far, in order of
+// arrival. Cancellations are not included.
+func (s *Server) RequestIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.ids...)
+}
+
+// Count returns the current value of the counter of a state key.
+func (s *Server) Count(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.state(key).count
+}
+
+func (s *Server) topic(key string) *topic {
+	t, ok := s.topics[key]
+	if !ok {
+		t = &topic{notify: make(chan struct{})}
+		s.topics[key] = t
+	}
+	return t
+}
+
+func (s *Server) state(key string) *state {
+	st, ok := s.states[key]
+	if !ok {
+		st = &state{notify: make(chan struct{})}
+		s.states[key] = st
+	}
+	return st
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if s.AuthToken != "" && r.Header.Get("Authorization") != "Bearer "+s.AuthToken {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{InsecureSkipVerify: true})
+	if err != nil {
+		return
+	}
+	s.serve(&wsWire{ws})
+}
+
+// serve serves the requests of a client connection until it drops.
+func (s *Server) serve(w wire) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &conn{
+		srv:     s,
+		wire:    w,
+		ctx:     ctx,
+		cancel:  cancel,
+		cancels: make(map[string]context.CancelFunc),
+	}
+
+	s.mu.Lock()
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+
+		cancel()
+		c.wg.Wait()
+	}()
+
+	err := c.consumeRequests()
+	w.close(errors.Is(err, io.EOF) || websocket.CloseStatus(err) == websocket.StatusNormalClosure)
+}
+
+// wire reads requests from, and writes responses to, a client connection.
+type wire interface {
+	read(ctx context.Context) (*tgsync.Request, error)
+	write(ctx context.Context, res *tgsync.Response) error
+	// close closes the connection; normal is false if it's being dropped.
+	close(normal bool)
+}
+
+type wsWire struct {
+	ws *websocket.Conn
+}
+
+func (w *wsWire) read(ctx context.Context) (*tgsync.Request, error) {
+	var req *tgsync.Request
+	if err := wsjson.Read(ctx, w.ws, &req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (w *wsWire) write(ctx context.Context, res *tgsync.Response) error {
+	return wsjson.Write(ctx, w.ws, res)
+}
+
+func (w *wsWire) close(normal bool) {
+	if normal {
+		_ = w.ws.Close(websocket.StatusNormalClosure, "")
+	} else {
+		_ = w.ws.Close(websocket.StatusGoingAway, "connection dropped")
+	}
+}
+
+// tcpWire frames JSON messages with a 4-byte big-endian length prefix. Reads
+// are interrupted by closing the connection.
+type tcpWire struct {
+	conn net.Conn
+	r    *bufio.Reader
+	mu   sync.Mutex
+}
+
+func (w *tcpWire) read(_ context.Context) (*tgsync.Request, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(w.r, hdr[:]); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+	if _, err := io.ReadFull(w.r, frame); err != nil {
+		return nil, err
+	}
+	var req *tgsync.Request
+	if err := json.Unmarshal(frame, &req); err != nil {
+		return nil, fmt.Errorf("failed to decode request: %w", err)
+	}
+	return req, nil
+}
+
+func (w *tcpWire) write(ctx context.Context, res *tgsync.Response) error {
+	payload, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[4:], payload)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	deadline, _ := ctx.Deadline()
+	_ = w.conn.SetWriteDeadline(deadline)
+	_, err = w.conn.Write(frame)
+	return err
+}
+
+func (w *tcpWire) close(bool) {
+	_ = w.conn.Close()
+}
+
+// conn serves the requests of a single client connection.
+type conn struct {
+	srv    *Server
+	wire   wire
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// cancels contains cancel functions for requests that can be cancelled,
+	// i.e. subscriptions and barriers.
+	cancelsMu sync.Mutex
+	cancels   map[string]context.CancelFunc
+}
+
+func (c *conn) consumeRequests() error {
+	for {
+		req, err := c.wire.read(c.ctx)
+		if err != nil {
+			return err
+		}
+		if req == nil {
+			return errors.New("received nil request")
+		}
+
+		if req.IsCancel {
+			c.cancelsMu.Lock()
+			cancel := c.cancels[req.ID]
+			delete(c.cancels, req.ID)
+			c.cancelsMu.Unlock()
+
+			if cancel != nil {
+				cancel()
+			}
+			continue
+		}
+
+		c.srv.mu.Lock()
+		c.srv.ids = append(c.srv.ids, req.ID)
+		c.srv.mu.Unlock()
+
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+
+			switch {
+			case req.PublishRequest != nil:
+				c.publish(req.ID, req.PublishRequest)
+			case req.SubscribeRequest != nil:
+				c.subscribe(req.ID, req.SubscribeRequest)
+			case req.BarrierRequest != nil:
+				c.barrier(req.ID, req.BarrierRequest)
+			case req.SignalEntryRequest != nil:
+				c.signalEntry(req.ID, req.SignalEntryRequest)
+			default:
+				c.respond(&tgsync.Response{ID: req.ID, Error: "unrecognized request"})
+			}
+		}()
+	}
+}
+
+// cancellable registers a cancellable context for the request.
+func (c *conn) cancellable(id string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(c.ctx)
+
+	c.cancelsMu.Lock()
+	c.cancels[id] = cancel
+	c.cancelsMu.Unlock()
+
+	return ctx, func() {
+		c.cancelsMu.Lock()
+		delete(c.cancels, id)
+		c.cancelsMu.Unlock()
+		cancel()
+	}
+}
+
+func (c *conn) respond(res *tgsync.Response) {
+	ctx, cancel := context.WithTimeout(c.ctx, 10*time.Second)
+	defer cancel()
+
+	if err := c.wire.write(ctx, res); err != nil {
+		c.cancel()
+	}
+}
+
+func (c *conn) publish(id string, req *tgsync.PublishRequest) {
+	bytes, err := json.Marshal(req.Payload)
+	if err != nil {
+		c.respond(&tgsync.Response{ID: id, Error: err.Error()})
+		return
+	}
+
+	c.srv.mu.Lock()
+	t := c.srv.topic(req.Topic)
+	t.entries = append(t.entries, string(bytes))
+	seq := len(t.entries)
+	close(t.notify)
+	t.notify = make(chan struct{})
+	c.srv.mu.Unlock()
+
+	c.respond(&tgsync.Response{ID: id, PublishResponse: &tgsync.PublishResponse{Seq: seq}})
+}
+
+func (c *conn) subscribe(id string, req *tgsync.SubscribeRequest) {
+	ctx, cancel := c.cancellable(id)
+	defer cancel()
+
+	for idx := 0; ; {
+		c.srv.mu.Lock()
+		t := c.srv.topic(req.Topic)
+		entries, notify := t.entries[idx:], t.notify
+		c.srv.mu.Unlock()
+
+		for _, e := range entries {
+			if ctx.Err() != nil {
+				return
+			}
+			c.respond(&tgsync.Response{ID: id, SubscribeResponse: e})
+		}
+		idx += len(entries)
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *conn) barrier(id string, req *tgsync.BarrierRequest) {
+	ctx, cancel := c.cancellable(id)
+	defer cancel()
+
+	for {
+		c.srv.mu.Lock()
+		st := c.srv.state(req.State)
+		count, notify := st.count, st.notify
+		c.srv.mu.Unlock()
+
+		if count >= req.Target {
+			c.respond(&tgsync.Response{ID: id})
+			return
+		}
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *conn) signalEntry(id string, req *tgsync.SignalEntryRequest) {
+	c.srv.mu.Lock()
+	st := c.srv.state(req.State)
+	st.count++
+	seq := st.count
+	close(st.notify)
+	st.notify = make(chan struct{})
+	c.srv.mu.Unlock()
+
+	c.respond(&tgsync.Response{ID: id, SignalEntryResponse: &tgsync.SignalEntryResponse{Seq: seq}})
+}
@@ -0,0 +1,61 @@
+package synctest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/testground/sdk-go/runtime"
+	"github.com/testground/sdk-go/sync"
+	"github.com/testground/sdk-go/sync/synctest"
+)
+
+func TestDefaultClientEndToEnd(t *testing.T) {
+	srv := synctest.NewServer()
+	defer srv.Close()
+
+	t.Setenv(sync.EnvServiceHost, srv.Host())
+	t.Setenv(sync.EnvServicePort, srv.Port())
+
+	runenv, cleanup := runtime.RandomTestRunEnv(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	a := sync.MustBoundClient(ctx, runenv)
+	defer a.Close()
+	b := sync.MustBoundClient(ctx, runenv)
+	defer b.Close()
+
+	type addr struct{ Host string }
+	topic := sync.NewTopic("addrs", &addr{})
+
+	require.EqualValues(t, 1, a.MustPublish(ctx, topic, &addr{"a"}))
+	ch := make(chan *addr, 2)
+	_, sub := b.MustPublishSubscribe(ctx, topic, &addr{"b"}, ch)
+	require.Equal(t, &addr{"a"}, <-ch)
+	require.Equal(t, &addr{"b"}, <-ch)
+	require.Len(t, srv.Entries(topic.Key(&runenv.RunParams)), 2)
+
+	state := sync.State("ready")
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := a.SignalAndWait(ctx, state, 2)
+		errCh <- err
+	}()
+	_, err := b.SignalAndWait(ctx, state, 2)
+	require.NoError(t, err)
+	require.NoError(t, <-errCh)
+	require.Equal(t, 2, srv.Count(state.Key(&runenv.RunParams)))
+
+	events, err := a.SubscribeEvents(ctx, &runenv.RunParams)
+	require.NoError(t, err)
+	evt := &runtime.Event{StageStartEvent: &runtime.StageStartEvent{Name: "stage", TestGroupID: "group"}}
+	require.NoError(t, b.SignalEvent(ctx, evt))
+	require.Equal(t, evt, <-events)
+
+	cancel()
+	require.NoError(t, <-sub.Done())
+}
@@ -0,0 +1,215 @@
+package sync
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	tgsync "github.com/testground/sync-service"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// MaxFrameSize is the largest frame accepted by the TCP transport, as a guard
+// against corrupt length prefixes.
+var MaxFrameSize = 64 << 20
+
+// ErrTransportClosed is returned by the operations of a Transport that has been
+// closed.
+var ErrTransportClosed = errors.New("transport closed")
+
+// Transport is a connection to the sync service, carrying requests to it and
+// responses back.
+//
+// The DefaultClient serializes calls to Write, and calls Read from a single
+// goroutine. Both must return when the supplied context fires. Once Read fails,
+// the DefaultClient considers the connection lost, closes the Transport, and
+// dials a new one.
+type Transport interface {
+	io.Closer
+
+	// Read blocks until the next response is received.
+	Read(ctx context.Context) (*tgsync.Response, error)
+	// Write sends a request.
+	Write(ctx context.Context, req *tgsync.Request) error
+}
+
+// Dialer establishes Transports to the sync service. The DefaultClient calls it
+// once on creation, and again on every reconnection.
+type Dialer func(ctx context.Context) (Transport, error)
+
+// DialerFor returns the Dialer for the supplied address, chosen by its scheme:
+//
+//	ws://host:port       websocket (the sync service)
+//	wss://host:port      websocket over TLS
+//	tcp://host:port      length-prefixed JSON frames; over TLS if tlsConfig is set
+//	redis://host:port    Redis streams, bypassing the sync service
+//	rediss://host:port   Redis streams over TLS
+//
+// tlsConfig may be nil, in which case the default configuration is used by the
+// schemes that require TLS; it must be nil for the insecure ws:// and redis://
+// schemes.
+func DialerFor(addr string, tlsConfig *tls.Config) (Dialer, error) {
+	if addr == "" {
+		return nil, errors.New("empty sync service address")
+	}
+	opts := ClientOptions{Address: addr, TLS: tlsConfig}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return opts.dialer()
+}
+
+// WebSocketDialer dials the sync service over a websocket, at a ws:// or wss://
+// address. tlsConfig, if set, configures the TLS connection of wss://
+// addresses.
+func WebSocketDialer(addr string, tlsConfig *tls.Config) Dialer {
+	return webSocketDialer(addr, tlsConfig, nil)
+}
+
+// webSocketDialer is like WebSocketDialer, sending the supplied headers in the
+// handshake.
+func webSocketDialer(addr string, tlsConfig *tls.Config, header http.Header) Dialer {
+	return func(ctx context.Context) (Transport, error) {
+		opts := &websocket.DialOptions{HTTPHeader: header}
+		if tlsConfig != nil {
+			opts.HTTPClient = &http.Client{
+				Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			}
+		}
+		conn, _, err := websocket.Dial(ctx, addr, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &wsTransport{conn: conn}, nil
+	}
+}
+
+type wsTransport struct {
+	conn *websocket.Conn
+}
+
+func (t *wsTransport) Read(ctx context.Context) (*tgsync.Response, error) {
+	var res *tgsync.Response
+	if err := wsjson.Read(ctx, t.conn, &res); err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, errors.New("received nil from socket")
+	}
+	return res, nil
+}
+
+func (t *wsTransport) Write(ctx context.Context, req *tgsync.Request) error {
+	return wsjson.Write(ctx, t.conn, req)
+}
+
+func (t *wsTransport) Close() error {
+	return t.conn.Close(websocket.StatusNormalClosure, "")
+}
+
+// TCPDialer dials the sync service over a plain TCP connection, or over TLS if
+// tlsConfig is set. Requests and responses are JSON-encoded, and framed with a
+// 4-byte big-endian length prefix.
+func TCPDialer(addr string, tlsConfig *tls.Config) Dialer {
+	return func(ctx context.Context) (Transport, error) {
+		var (
+			d    net.Dialer
+			conn net.Conn
+			err  error
+		)
+		if tlsConfig != nil {
+			conn, err = (&tls.Dialer{NetDialer: &d, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+		} else {
+			conn, err = d.DialContext(ctx, "tcp", addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &tcpTransport{conn: conn, r: bufio.NewReader(conn)}, nil
+	}
+}
+
+type tcpTransport struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// interruptible applies the deadline of the context to the connection through
+// setDeadline, and interrupts the pending I/O if the context fires. The
+// returned function must be called once the I/O has completed.
+func interruptible(ctx context.Context, setDeadline func(time.Time) error) (stop func()) {
+	deadline, _ := ctx.Deadline()
+	_ = setDeadline(deadline)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			_ = setDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+func (t *tcpTransport) Read(ctx context.Context) (*tgsync.Response, error) {
+	defer interruptible(ctx, t.conn.SetReadDeadline)()
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(t.r, hdr[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if int64(size) > int64(MaxFrameSize) {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the maximum of %d", size, MaxFrameSize)
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(t.r, frame); err != nil {
+		return nil, err
+	}
+
+	var res *tgsync.Response
+	if err := json.Unmarshal(frame, &res); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if res == nil {
+		return nil, errors.New("received nil from socket")
+	}
+	return res, nil
+}
+
+func (t *tcpTransport) Write(ctx context.Context, req *tgsync.Request) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	frame := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[4:], payload)
+
+	defer interruptible(ctx, t.conn.SetWriteDeadline)()
+	_, err = t.conn.Write(frame)
+	return err
+}
+
+func (t *tcpTransport) Close() error {
+	return t.conn.Close()
+}
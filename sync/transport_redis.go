@@ -0,0 +1,245 @@
+package sync
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	tgsync "github.com/testground/sync-service"
+)
+
+// RedisPollInterval is how long the Redis transport blocks waiting for new
+// entries of a topic, or polls the counter of a state.
+var RedisPollInterval = 100 * time.Millisecond
+
+// redisPayloadField is the field of the stream entries holding the payload.
+const redisPayloadField = "payload"
+
+// RedisDialer returns a Dialer of Transports that implement the sync service
+// protocol directly against a Redis server, for environments where the sync
+// service is unavailable. addr is a redis:// or rediss:// URL; tlsConfig, if
+// set, overrides the TLS configuration of rediss:// URLs.
+//
+// Each topic is stored as a Redis stream, and each state as a counter, whose
+// key is the topic or state key as sent by the client, e.g.
+// "run:<run>:plan:<plan>:case:<case>:states:<state>"; see State.Key and
+// Topic.Key. The layout is specific to this transport, so all instances of a
+// run must use the same backend.
+func RedisDialer(addr string, tlsConfig *tls.Config) Dialer {
+	return redisDialer(addr, tlsConfig, "")
+}
+
+// redisDialer is like RedisDialer, authenticating with the supplied password,
+// if any, instead of the one in the URL.
+func redisDialer(addr string, tlsConfig *tls.Config, password string) Dialer {
+	return func(ctx context.Context) (Transport, error) {
+		opts, err := redis.ParseURL(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis address %q: %w", addr, err)
+		}
+		if tlsConfig != nil {
+			opts.TLSConfig = tlsConfig
+		}
+		if password != "" {
+			opts.Password = password
+		}
+
+		rdb := redis.NewClient(opts)
+		if err := rdb.Ping(ctx).Err(); err != nil {
+			_ = rdb.Close()
+			return nil, fmt.Errorf("failed to reach redis: %w", err)
+		}
+
+		tctx, cancel := context.WithCancel(context.Background())
+		return &redisTransport{
+			rdb:       rdb,
+			ctx:       tctx,
+			cancel:    cancel,
+			responses: make(chan *tgsync.Response),
+			cancels:   make(map[string]context.CancelFunc),
+		}, nil
+	}
+}
+
+// redisTransport serves every request on a goroutine of its own, and funnels
+// the responses to Read.
+type redisTransport struct {
+	rdb       *redis.Client
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	responses chan *tgsync.Response
+
+	// cancels holds the cancel functions of the requests being served.
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+func (t *redisTransport) Read(ctx context.Context) (*tgsync.Response, error) {
+	select {
+	case res := <-t.responses:
+		return res, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-t.ctx.Done():
+		return nil, ErrTransportClosed
+	}
+}
+
+func (t *redisTransport) Write(_ context.Context, req *tgsync.Request) error {
+	if t.ctx.Err() != nil {
+		return ErrTransportClosed
+	}
+
+	if req.IsCancel {
+		t.mu.Lock()
+		cancel := t.cancels[req.ID]
+		t.mu.Unlock()
+		if cancel != nil {
+			cancel()
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(t.ctx)
+	t.mu.Lock()
+	t.cancels[req.ID] = cancel
+	t.mu.Unlock()
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer func() {
+			t.mu.Lock()
+			delete(t.cancels, req.ID)
+			t.mu.Unlock()
+			cancel()
+		}()
+
+		var err error
+		switch {
+		case req.PublishRequest != nil:
+			err = t.publish(ctx, req.ID, req.PublishRequest)
+		case req.SubscribeRequest != nil:
+			err = t.subscribe(ctx, req.ID, req.SubscribeRequest)
+		case req.BarrierRequest != nil:
+			err = t.barrier(ctx, req.ID, req.BarrierRequest)
+		case req.SignalEntryRequest != nil:
+			err = t.signalEntry(ctx, req.ID, req.SignalEntryRequest)
+		default:
+			err = errors.New("unrecognized request")
+		}
+		if err != nil && ctx.Err() == nil {
+			t.respond(ctx, &tgsync.Response{ID: req.ID, Error: err.Error()})
+		}
+	}()
+	return nil
+}
+
+// Close cancels all requests being served, and closes the connection to
+// Redis. Data stored in Redis is retained.
+func (t *redisTransport) Close() error {
+	t.cancel()
+	t.wg.Wait()
+	return t.rdb.Close()
+}
+
+func (t *redisTransport) respond(ctx context.Context, res *tgsync.Response) {
+	select {
+	case t.responses <- res:
+	case <-ctx.Done():
+	}
+}
+
+func (t *redisTransport) publish(ctx context.Context, id string, req *tgsync.PublishRequest) error {
+	payload, err := json.Marshal(req.Payload)
+	if err != nil {
+		return err
+	}
+
+	// the length of the stream right after appending is the sequence number
+	// of the entry.
+	var length *redis.IntCmd
+	_, err = t.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.XAdd(ctx, &redis.XAddArgs{
+			Stream: req.Topic,
+			Values: []string{redisPayloadField, string(payload)},
+		})
+		length = p.XLen(ctx, req.Topic)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	t.respond(ctx, &tgsync.Response{ID: id, PublishResponse: &tgsync.PublishResponse{Seq: int(length.Val())}})
+	return nil
+}
+
+func (t *redisTransport) subscribe(ctx context.Context, id string, req *tgsync.SubscribeRequest) error {
+	for last := "0"; ; {
+		streams, err := t.rdb.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{req.Topic, last},
+			Block:   RedisPollInterval,
+		}).Result()
+
+		switch {
+		case errors.Is(err, redis.Nil):
+			continue
+		case err != nil:
+			return err
+		}
+
+		for _, s := range streams {
+			for _, msg := range s.Messages {
+				last = msg.ID
+				payload, _ := msg.Values[redisPayloadField].(string)
+				t.respond(ctx, &tgsync.Response{ID: id, SubscribeResponse: payload})
+			}
+		}
+	}
+}
+
+func (t *redisTransport) barrier(ctx context.Context, id string, req *tgsync.BarrierRequest) error {
+	ticker := time.NewTicker(RedisPollInterval)
+	defer ticker.Stop()
+
+	for {
+		v, err := t.rdb.Get(ctx, req.State).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+
+		var count int
+		if v != "" {
+			if count, err = strconv.Atoi(v); err != nil {
+				return fmt.Errorf("invalid counter for state %s: %w", req.State, err)
+			}
+		}
+		if count >= req.Target {
+			t.respond(ctx, &tgsync.Response{ID: id})
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (t *redisTransport) signalEntry(ctx context.Context, id string, req *tgsync.SignalEntryRequest) error {
+	seq, err := t.rdb.Incr(ctx, req.State).Result()
+	if err != nil {
+		return err
+	}
+	t.respond(ctx, &tgsync.Response{ID: id, SignalEntryResponse: &tgsync.SignalEntryResponse{Seq: int(seq)}})
+	return nil
+}
@@ -0,0 +1,75 @@
+package sync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/testground/sdk-go/runtime"
+	"github.com/testground/sdk-go/sync/synctest"
+)
+
+func TestTransports(t *testing.T) {
+	dialers := map[string]func(t *testing.T) Dialer{
+		"wss": func(t *testing.T) Dialer {
+			srv := synctest.NewTLSServer()
+			t.Cleanup(srv.Close)
+			return WebSocketDialer(srv.Addr(), srv.ClientTLSConfig())
+		},
+		"tcp": func(t *testing.T) Dialer {
+			srv := synctest.NewServer()
+			t.Cleanup(srv.Close)
+			addr, err := srv.ServeTCP()
+			require.NoError(t, err)
+			dial, err := DialerFor(addr, nil)
+			require.NoError(t, err)
+			return dial
+		},
+		"redis": func(t *testing.T) Dialer {
+			mr := miniredis.RunT(t)
+			dial, err := DialerFor("redis://"+mr.Addr(), nil)
+			require.NoError(t, err)
+			return dial
+		},
+	}
+
+	for name, dialer := range dialers {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			runenv, cleanup := runtime.RandomTestRunEnv(t)
+			t.Cleanup(cleanup)
+
+			dial := dialer(t)
+			a, err := NewBoundClientWithDialer(ctx, runenv, dial)
+			require.NoError(t, err)
+			defer a.Close()
+			b, err := NewBoundClientWithDialer(ctx, runenv, dial)
+			require.NoError(t, err)
+			defer b.Close()
+
+			topic := NewTopic("transport", "")
+			require.EqualValues(t, 1, a.MustPublish(ctx, topic, "a"))
+			ch := make(chan string, 2)
+			seq, _ := b.MustPublishSubscribe(ctx, topic, "b", ch)
+			require.EqualValues(t, 2, seq)
+			require.Equal(t, "a", <-ch)
+			require.Equal(t, "b", <-ch)
+
+			errCh := make(chan error, 1)
+			go func() {
+				_, err := a.SignalAndWait(ctx, "ready", 2)
+				errCh <- err
+			}()
+			_, err = b.SignalAndWait(ctx, "ready", 2)
+			require.NoError(t, err)
+			require.NoError(t, <-errCh)
+		})
+	}
+
+	_, err := DialerFor("http://localhost:5050", nil)
+	require.Error(t, err)
+}
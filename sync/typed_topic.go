@@ -0,0 +1,106 @@
+package sync
+
+import (
+	"context"
+	"reflect"
+)
+
+// TypedTopicBuffer is the capacity of the channels returned by
+// TypedTopic.Subscribe.
+var TypedTopicBuffer = 32
+
+// TypedTopic is a Topic carrying values of type T, bound to a Client. It is a
+// compile-time checked alternative to calling Publish and Subscribe on the
+// Client with an untyped payload and channel.
+//
+// T can be a value or a pointer type; in both cases, payloads travel as the
+// JSON encoding of the pointed-to value, so a TypedTopic[Foo] and a
+// TypedTopic[*Foo] with the same name are interchangeable, and also
+// interoperate with a Topic constructed through NewTopic.
+type TypedTopic[T any] struct {
+	*Topic
+
+	client Client
+}
+
+// NewTypedTopic constructs a TypedTopic with the provided name, carrying values
+// of type T, and bound to the supplied Client.
+func NewTypedTopic[T any](client Client, name string) *TypedTopic[T] {
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	return &TypedTopic[T]{
+		Topic:  NewTopic(name, typ),
+		client: client,
+	}
+}
+
+// WithCodec returns a copy of this TypedTopic whose payloads are encoded with
+// the supplied Codec. See Topic.WithCodec.
+func (t *TypedTopic[T]) WithCodec(codec Codec) *TypedTopic[T] {
+	return &TypedTopic[T]{
+		Topic:  t.Topic.WithCodec(codec),
+		client: t.client,
+	}
+}
+
+// InGroup returns a copy of this TypedTopic scoped to the supplied group. See
+// State.InGroup.
+func (t *TypedTopic[T]) InGroup(group string) *TypedTopic[T] {
+	return &TypedTopic[T]{
+		Topic:  t.Topic.InGroup(group),
+		client: t.client,
+	}
+}
+
+// Global returns a copy of this TypedTopic that is not scoped to the run, plan
+// or case. See State.Global.
+func (t *TypedTopic[T]) Global() *TypedTopic[T] {
+	return &TypedTopic[T]{
+		Topic:  t.Topic.Global(),
+		client: t.client,
+	}
+}
+
+// Publish publishes a value on this topic, returning its sequence number. See
+// Client.Publish for details.
+func (t *TypedTopic[T]) Publish(ctx context.Context, v T) (seq int64, err error) {
+	return t.client.Publish(ctx, t.Topic, v)
+}
+
+// Subscribe subscribes to this topic, returning a channel where the values
+// published on it will be delivered in order, starting with the first. See
+// Client.Subscribe for details.
+//
+// The returned channel is buffered with TypedTopicBuffer elements. The caller
+// must consume from it promptly. It is closed when the subscription ends, as
+// if the CloseOnDone option were supplied; Subscription.Err tells why.
+func (t *TypedTopic[T]) Subscribe(ctx context.Context, opts ...SubscribeOption) (<-chan T, *Subscription, error) {
+	ch := make(chan T, TypedTopicBuffer)
+	opts = append(opts[:len(opts):len(opts)], CloseOnDone())
+	sub, err := t.client.Subscribe(ctx, t.Topic, ch, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ch, sub, nil
+}
+
+// MustPublish calls Publish, panicking if it errors.
+//
+// Suitable for shorthanding in test plans.
+func (t *TypedTopic[T]) MustPublish(ctx context.Context, v T) (seq int64) {
+	seq, err := t.Publish(ctx, v)
+	if err != nil {
+		panic(err)
+	}
+	return seq
+}
+
+// MustSubscribe calls Subscribe, panicking if it errors.
+//
+// Suitable for shorthanding in test plans.
+func (t *TypedTopic[T]) MustSubscribe(ctx context.Context, opts ...SubscribeOption) (<-chan T, *Subscription) {
+	ch, sub, err := t.Subscribe(ctx, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return ch, sub
+}
@@ -0,0 +1,61 @@
+package sync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/testground/sdk-go/runtime"
+)
+
+func TestTypedTopic(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := NewInmemHub().NewBoundClient(&runtime.RunParams{TestRun: "run"})
+	defer client.Close()
+
+	type peer struct {
+		ID    string
+		Addrs []string
+	}
+
+	values := NewTypedTopic[peer](client, "peers")
+	pointers := NewTypedTopic[*peer](client, "peers")
+
+	require.EqualValues(t, 1, values.MustPublish(ctx, peer{ID: "a"}))
+	require.EqualValues(t, 2, pointers.MustPublish(ctx, &peer{ID: "b", Addrs: []string{"/ip4/1.2.3.4"}}))
+
+	vch, _ := values.MustSubscribe(ctx)
+	require.Equal(t, peer{ID: "a"}, <-vch)
+	require.Equal(t, peer{ID: "b", Addrs: []string{"/ip4/1.2.3.4"}}, <-vch)
+
+	pch, _ := pointers.MustSubscribe(ctx)
+	require.Equal(t, &peer{ID: "a"}, <-pch)
+
+	// typed topics interoperate with untyped ones.
+	ch := make(chan *peer, 2)
+	client.MustSubscribe(ctx, NewTopic("peers", &peer{}), ch)
+	require.Equal(t, "a", (<-ch).ID)
+}
+
+func TestTypedTopicClosesChannel(t *testing.T) {
+	forEachClient(t, func(t *testing.T, client Client) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		topic := NewTypedTopic[string](client, "closing")
+		topic.MustPublish(ctx, "a")
+
+		sctx, scancel := context.WithCancel(ctx)
+		ch, sub := topic.MustSubscribe(sctx)
+		require.Equal(t, "a", <-ch)
+		scancel()
+
+		// ranging over the channel ends once the subscription does.
+		for range ch {
+		}
+		require.Error(t, sub.Err())
+	})
+}
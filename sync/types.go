@@ -1,9 +1,14 @@
 package sync
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/testground/sdk-go/runtime"
 )
@@ -12,18 +17,206 @@ import (
 // unique string within the test case.
 type State string
 
-// Key gets the Redis key for this State, contextualized to a set of RunParams.
+// Key gets the Redis key for this State, contextualized to a set of RunParams,
+// unless the State is global.
 func (s State) Key(rp *runtime.RunParams) string {
+	if name, ok := globalName(string(s)); ok {
+		return fmt.Sprintf("global:states:%s", name)
+	}
 	p := fmt.Sprintf("run:%s:plan:%s:case:%s:states:%s", rp.TestRun, rp.TestPlan, rp.TestCase, string(s))
 	return p
 }
 
+// InGroup returns a State with the same name, scoped to the supplied group.
+// Instances of other groups using the plain State, or the State scoped to
+// their own group, won't interfere with it.
+func (s State) InGroup(group string) State {
+	return State(inGroup(string(s), group))
+}
+
+// Global returns a State with the same name, not scoped to the run, plan or
+// case. It is shared by all instances of all runs, which is useful to
+// coordinate multi-run experiments.
+func (s State) Global() State {
+	return State(global(string(s)))
+}
+
+// Scopes are encoded as prefixes of the names of states and topics; names
+// starting with "@" are reserved.
+const (
+	groupPrefix  = "@group:"
+	globalPrefix = "@global/"
+)
+
+func inGroup(name string, group string) string {
+	if n, ok := globalName(name); ok {
+		return global(groupPrefix + group + "/" + n)
+	}
+	return groupPrefix + group + "/" + name
+}
+
+func global(name string) string {
+	if _, ok := globalName(name); ok {
+		return name
+	}
+	return globalPrefix + name
+}
+
+// globalName strips the global scope from a name, returning whether it had
+// it.
+func globalName(name string) (string, bool) {
+	if !strings.HasPrefix(name, globalPrefix) {
+		return name, false
+	}
+	return strings.TrimPrefix(name, globalPrefix), true
+}
+
 // Barrier represents a barrier over a State. A Barrier is a synchronisation
 // checkpoint that will fire once the `target` number of entries on that state
 // have been registered.
 type Barrier struct {
-	C      chan error
-	target int64 // Only kept for client_inmem.go
+	C chan error
+}
+
+// Arrival records the entry of an instance into a State, as registered by
+// SignalAndWaitTimeout.
+type Arrival struct {
+	// GroupID is the group of the instance.
+	GroupID string `json:"group"`
+	// GroupInstances is the number of instances in that group.
+	GroupInstances int `json:"group_instances"`
+	// GroupSeq identifies the instance within its group: it is the position of
+	// the instance among the arrivals of its group, from 1.
+	GroupSeq int64 `json:"group_seq"`
+	// Seq is the value of the state counter after the instance signalled
+	// entry.
+	Seq int64 `json:"seq"`
+}
+
+func (a Arrival) String() string {
+	return fmt.Sprintf("%s#%d", a.GroupID, a.GroupSeq)
+}
+
+// BarrierTimeoutError is returned by SignalAndWaitTimeout when the barrier
+// isn't met in time. It reports who arrived, and who is missing, based on the
+// arrivals registered by instances entering the state with
+// SignalAndWaitTimeout.
+type BarrierTimeoutError struct {
+	State  State
+	Target int
+	// Current is the number of instances known to have entered the state.
+	Current int
+	// Arrivals are the arrivals registered before the timeout, by group and
+	// GroupSeq.
+	Arrivals []Arrival
+	// Missing lists, by group, the GroupSeqs of the instances that didn't
+	// arrive. The size of the group of the reporting instance is known from
+	// its RunParams; that of other groups, from their arrivals.
+	Missing map[string][]int64
+	// Unaccounted is the number of missing instances that can't be
+	// attributed to a group, as no instance of their group arrived.
+	Unaccounted int
+}
+
+// newBarrierTimeoutError builds the report for a barrier that timed out, as
+// seen by an instance with the supplied RunParams.
+func newBarrierTimeoutError(state State, target int, rp *runtime.RunParams, arrivals []Arrival) *BarrierTimeoutError {
+	sort.Slice(arrivals, func(i, j int) bool {
+		if arrivals[i].GroupID != arrivals[j].GroupID {
+			return arrivals[i].GroupID < arrivals[j].GroupID
+		}
+		return arrivals[i].GroupSeq < arrivals[j].GroupSeq
+	})
+
+	e := &BarrierTimeoutError{
+		State:    state,
+		Target:   target,
+		Current:  len(arrivals),
+		Arrivals: arrivals,
+		Missing:  make(map[string][]int64),
+	}
+
+	sizes := map[string]int{rp.TestGroupID: rp.TestGroupInstanceCount}
+	arrived := make(map[string]map[int64]bool)
+	for _, a := range arrivals {
+		// instances that signalled entry without registering their arrival
+		// still count towards the target.
+		if int(a.Seq) > e.Current {
+			e.Current = int(a.Seq)
+		}
+		if _, ok := sizes[a.GroupID]; !ok {
+			sizes[a.GroupID] = a.GroupInstances
+		}
+		if arrived[a.GroupID] == nil {
+			arrived[a.GroupID] = make(map[int64]bool)
+		}
+		arrived[a.GroupID][a.GroupSeq] = true
+	}
+
+	missing := 0
+	for g, size := range sizes {
+		for seq := int64(1); seq <= int64(size); seq++ {
+			if !arrived[g][seq] {
+				e.Missing[g] = append(e.Missing[g], seq)
+				missing++
+			}
+		}
+	}
+	if n := target - e.Current - missing; n > 0 {
+		e.Unaccounted = n
+	}
+	return e
+}
+
+func (e *BarrierTimeoutError) Error() string {
+	groups := make([]string, 0, len(e.Missing))
+	for g := range e.Missing {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "barrier on state %s timed out at %d/%d", e.State, e.Current, e.Target)
+	for i, g := range groups {
+		if i == 0 {
+			b.WriteString("; missing:")
+		} else {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, " %s#%s", g, formatSeqs(e.Missing[g]))
+	}
+	if e.Unaccounted > 0 {
+		fmt.Fprintf(&b, "; %d unaccounted", e.Unaccounted)
+	}
+	return b.String()
+}
+
+// formatSeqs formats ascending sequence numbers compactly, as ranges, e.g.
+// "{1-3,5}", or "2" if there's a single one.
+func formatSeqs(seqs []int64) string {
+	if len(seqs) == 1 {
+		return strconv.FormatInt(seqs[0], 10)
+	}
+
+	var parts []string
+	for i := 0; i < len(seqs); {
+		j := i
+		for j+1 < len(seqs) && seqs[j+1] == seqs[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.FormatInt(seqs[i], 10))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", seqs[i], seqs[j]))
+		}
+		i = j + 1
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// Unwrap makes the error match context.DeadlineExceeded.
+func (e *BarrierTimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
 }
 
 // Topic represents a meeting place for test instances to exchange arbitrary
@@ -44,18 +237,52 @@ func NewTopic(name string, typ interface{}) *Topic {
 	}
 	return &Topic{
 		name:          name,
-		typeValidator: &typeValidator{t},
+		typeValidator: &typeValidator{typ: t},
+	}
+}
+
+// WithCodec returns a copy of this Topic whose payloads are encoded with the
+// supplied Codec, instead of the default JSONCodec. All publishers and
+// subscribers of a topic must agree on the codec; subscribers fail to decode
+// entries encoded with another codec, with an ErrCodecMismatch error.
+func (t *Topic) WithCodec(codec Codec) *Topic {
+	return &Topic{
+		name:          t.name,
+		typeValidator: &typeValidator{typ: t.typ, codec: codec},
+	}
+}
+
+// InGroup returns a copy of this Topic scoped to the supplied group. See
+// State.InGroup.
+func (t *Topic) InGroup(group string) *Topic {
+	return &Topic{
+		name:          inGroup(t.name, group),
+		typeValidator: t.typeValidator,
 	}
 }
 
-// Key gets the key for this Topic, contextualized to a set of RunParams.
+// Global returns a copy of this Topic that is not scoped to the run, plan or
+// case. See State.Global.
+func (t *Topic) Global() *Topic {
+	return &Topic{
+		name:          global(t.name),
+		typeValidator: t.typeValidator,
+	}
+}
+
+// Key gets the key for this Topic, contextualized to a set of RunParams,
+// unless the Topic is global.
 func (t Topic) Key(rp *runtime.RunParams) string {
+	if name, ok := globalName(t.name); ok {
+		return fmt.Sprintf("global:topics:%s", name)
+	}
 	p := fmt.Sprintf("run:%s:plan:%s:case:%s:topics:%s", rp.TestRun, rp.TestPlan, rp.TestCase, t.name)
 	return p
 }
 
 type typeValidator struct {
-	typ reflect.Type
+	typ   reflect.Type
+	codec Codec
 }
 
 func (t typeValidator) validatePayload(val interface{}) bool {
@@ -69,19 +296,25 @@ func (t typeValidator) validatePayload(val interface{}) bool {
 	return ttyp == vtyp
 }
 
-// decodePayload extracts a value of the specified type from incoming json.
-func (t typeValidator) decodePayload(val interface{}) (reflect.Value, error) {
+// encodePayload encodes a validated payload with the codec, returning the
+// value to publish.
+func (t typeValidator) encodePayload(val interface{}) (interface{}, error) {
+	return encode(t.codec, val)
+}
+
+// decodePayload extracts a value of the specified type from an incoming
+// entry, encoded with the codec.
+func (t typeValidator) decodePayload(raw string) (reflect.Value, error) {
 	// Deserialize the value.
 	typ := t.typ
 	if typ.Kind() == reflect.Ptr {
 		typ = typ.Elem()
 	}
 	payload := reflect.New(typ)
-	raw, ok := val.(string)
-	if !ok {
-		panic("payload not a string")
-	}
-	if err := json.Unmarshal([]byte(raw), payload.Interface()); err != nil {
+	if err := decode(t.codec, raw, payload.Interface()); err != nil {
+		if errors.Is(err, ErrCodecMismatch) {
+			return reflect.Value{}, fmt.Errorf("failed to decode as type %s: %w", t.typ, err)
+		}
 		return reflect.Value{}, fmt.Errorf("failed to decode as type %s: %s", t.typ, raw)
 	}
 	return payload, nil
@@ -91,8 +324,96 @@ func (t typeValidator) decodePayload(val interface{}) (reflect.Value, error) {
 // Topic.
 type Subscription struct {
 	doneCh chan error
+
+	topic  string
+	cancel context.CancelFunc
+	// ch is the subscriber's channel, to be closed on termination; it is only
+	// valid if the CloseOnDone option was set.
+	ch reflect.Value
+	// release is called on termination, to unregister the subscription from
+	// its client.
+	release func()
+
+	mu        sync.Mutex
+	cancelled bool
+	ended     bool
+	err       error
 }
 
+// newSubscription creates a Subscription to the topic with the supplied key,
+// which is cancelled by calling cancel. The goroutine serving the subscription
+// must terminate it through finish.
+func newSubscription(topic string, cancel context.CancelFunc) *Subscription {
+	return &Subscription{
+		doneCh: make(chan error, 1),
+		topic:  topic,
+		cancel: cancel,
+	}
+}
+
+// Done returns a channel that receives the error the subscription failed
+// with, or nil if it was cancelled, and is then closed.
 func (s *Subscription) Done() <-chan error {
 	return s.doneCh
 }
+
+// Topic returns the key of the topic this subscription consumes.
+func (s *Subscription) Topic() string {
+	return s.topic
+}
+
+// Cancel terminates the subscription, as if the context passed to Subscribe
+// had fired. It is safe to call Cancel multiple times, and after the
+// subscription has terminated.
+func (s *Subscription) Cancel() {
+	s.mu.Lock()
+	if !s.ended {
+		s.cancelled = true
+	}
+	s.mu.Unlock()
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// Err returns nil while the subscription is active. Once it has terminated, it
+// returns the error reported through Done or, if none, the reason it was
+// terminated: ErrSubscriptionCancelled if Cancel was called, ErrClientClosed
+// if the client was closed, or the error of the context passed to Subscribe.
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// finish terminates the subscription, reporting err through Done. If err is
+// nil, reason is the cause of the termination, as returned by Err.
+func (s *Subscription) finish(err, reason error) {
+	s.mu.Lock()
+	switch {
+	case err != nil:
+		s.err = err
+	case s.cancelled:
+		s.err = ErrSubscriptionCancelled
+	case reason != nil:
+		s.err = reason
+	default:
+		s.err = context.Canceled
+	}
+	s.ended = true
+	release := s.release
+	s.mu.Unlock()
+
+	if s.ch.IsValid() {
+		s.ch.Close()
+	}
+	if release != nil {
+		release()
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.doneCh <- err
+	close(s.doneCh)
+}
@@ -0,0 +1,46 @@
+package sync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/testground/sdk-go/runtime"
+)
+
+func TestScopedKeys(t *testing.T) {
+	rp := &runtime.RunParams{TestRun: "r", TestPlan: "p", TestCase: "c"}
+
+	state := State("ready")
+	require.Equal(t, "run:r:plan:p:case:c:states:ready", state.Key(rp))
+	require.Equal(t, "run:r:plan:p:case:c:states:@group:a/ready", state.InGroup("a").Key(rp))
+	require.Equal(t, "global:states:ready", state.Global().Key(rp))
+	require.Equal(t, "global:states:@group:a/ready", state.Global().InGroup("a").Key(rp))
+	require.Equal(t, state.Global().InGroup("a"), state.InGroup("a").Global())
+
+	topic := NewTopic("peers", "")
+	require.Equal(t, "run:r:plan:p:case:c:topics:@group:a/peers", topic.InGroup("a").Key(rp))
+	require.Equal(t, "global:topics:peers", topic.Global().Key(rp))
+	require.Equal(t, "run:r:plan:p:case:c:topics:peers", topic.Key(rp), "scoping must not modify the topic")
+}
+
+func TestScopedStatesAcrossRuns(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	hub := NewInmemHub()
+	a := hub.NewBoundClient(&runtime.RunParams{TestRun: "one", TestGroupID: "a"})
+	b := hub.NewBoundClient(&runtime.RunParams{TestRun: "two", TestGroupID: "a"})
+	defer a.Close()
+	defer b.Close()
+
+	state := State("done")
+	require.EqualValues(t, 1, a.MustSignalEntry(ctx, state.InGroup("a")))
+	require.EqualValues(t, 1, a.MustSignalEntry(ctx, state.InGroup("b")))
+	require.EqualValues(t, 1, a.MustSignalEntry(ctx, state.Global()))
+
+	// the global state is shared with other runs, the rest isn't.
+	require.EqualValues(t, 1, b.MustSignalEntry(ctx, state.InGroup("a")))
+	require.EqualValues(t, 2, b.MustSignalEntry(ctx, state.Global()))
+}